@@ -0,0 +1,97 @@
+package gdrive
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AccessStore = "store"
+	AccessTouch = "touch"
+	AccessGet   = "get"
+	AccessEvict = "evict"
+)
+
+type AccessEvent struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Filepath string    `json:"path"`
+	Size     int64     `json:"size"`
+}
+
+// AccessRecorder receives every store, touch, get and evict of the cache, set it in Config.AccessRecorder
+type AccessRecorder interface {
+	RecordAccess(event AccessEvent)
+}
+
+// accessWriter is implemented by the built-in recorders, their write errors go to the logger of the instance
+type accessWriter interface {
+	writeAccess(event AccessEvent) error
+}
+
+type jsonAccessRecorder struct {
+	mut sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAccessRecorder writes every event as a json line
+func NewJSONAccessRecorder(w io.Writer) AccessRecorder {
+	return &jsonAccessRecorder{enc: json.NewEncoder(w)}
+}
+
+func (r *jsonAccessRecorder) RecordAccess(event AccessEvent) {
+	if err := r.writeAccess(event); err != nil {
+		logrusLogger{}.Errorf("unable to record access event: %v", err)
+	}
+}
+
+func (r *jsonAccessRecorder) writeAccess(event AccessEvent) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.enc.Encode(event)
+}
+
+type csvAccessRecorder struct {
+	mut sync.Mutex
+	w   *csv.Writer
+}
+
+// NewCSVAccessRecorder writes every event as a time,op,path,size csv row
+func NewCSVAccessRecorder(w io.Writer) AccessRecorder {
+	return &csvAccessRecorder{w: csv.NewWriter(w)}
+}
+
+func (r *csvAccessRecorder) RecordAccess(event AccessEvent) {
+	if err := r.writeAccess(event); err != nil {
+		logrusLogger{}.Errorf("unable to record access event: %v", err)
+	}
+}
+
+func (r *csvAccessRecorder) writeAccess(event AccessEvent) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	err := r.w.Write([]string{event.Time.Format(time.RFC3339Nano), event.Op, event.Filepath, strconv.FormatInt(event.Size, 10)})
+	if err != nil {
+		return err
+	}
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func (g *GDrive) recordAccess(op, filePathName string, size int64) {
+	if g.config.AccessRecorder == nil {
+		return
+	}
+	event := AccessEvent{Time: g.now(), Op: op, Filepath: filePathName, Size: size}
+	if w, ok := g.config.AccessRecorder.(accessWriter); ok {
+		if err := w.writeAccess(event); err != nil {
+			g.logger().Errorf("unable to record access event: %v", err)
+		}
+		return
+	}
+	g.config.AccessRecorder.RecordAccess(event)
+}
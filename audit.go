@@ -0,0 +1,44 @@
+package gdrive
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	AuditDelete = "delete"
+	AuditEvict  = "evict"
+	AuditTrash  = "trash"
+	AuditPurge  = "purge"
+)
+
+// AuditEvent describes a destructive operation of the cache
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Filepath string    `json:"path"`
+	FileID   string    `json:"fileId"`
+	Size     int64     `json:"size"`
+	Actor    string    `json:"actor"` // set on the context with WithActor
+}
+
+// AuditLogger receives every delete, evict, trash and purge, set it in Config.AuditLogger.
+// Unlike the logger it receives every event, it is meant as an audit trail.
+type AuditLogger interface {
+	Audit(event AuditEvent)
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose operations are audited with the given actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func (g *GDrive) audit(ctx context.Context, op, filePathName, fileID string, size int64) {
+	if g.config.AuditLogger == nil {
+		return
+	}
+	actor, _ := ctx.Value(actorKey{}).(string)
+	g.config.AuditLogger.Audit(AuditEvent{Time: g.now(), Op: op, Filepath: filePathName, FileID: fileID, Size: size, Actor: actor})
+}
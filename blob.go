@@ -0,0 +1,128 @@
+package gdrive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// blobFolder holds the content addressed files under the local root when Config.ContentAddressedLocal is set,
+// every cached path is a hard link to the blob of its content
+const blobFolder = ".blobs"
+
+// contentHash returns the key of the content in the blob folder, empty when content addressing is disabled
+func (g *GDrive) contentHash(b []byte) string {
+	if !g.config.ContentAddressedLocal {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// localContentHash returns the content hash of the cached file, empty when content addressing is disabled
+func (g *GDrive) localContentHash(rel string) (string, error) {
+	if !g.config.ContentAddressedLocal {
+		return "", nil
+	}
+	f, err := os.Open(g.localFullPath(rel))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	_, err = io.Copy(sum, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+func (g *GDrive) blobPath(hash string) string {
+	return path.Join(g.config.LocalFolderRoot, blobFolder, hash)
+}
+
+func (g *GDrive) isBlobFolder(dir string) bool {
+	return filepath.Clean(dir) == filepath.Join(g.config.LocalFolderRoot, blobFolder)
+}
+
+// storeBlob writes the content once in the blob folder and links the cached path to it
+func (g *GDrive) storeBlob(localPath string, b []byte) error {
+	hash := g.contentHash(b)
+	blob := g.blobPath(hash)
+	err := g.mkdirAll(filepath.Dir(blob))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		// write to a unique temporary file first so a half written blob is never shared
+		tmp, err := g.writeTemp(filepath.Dir(blob), b)
+		if err != nil {
+			return err
+		}
+		return g.linkBlob(localPath, hash, tmp)
+	}
+	return g.linkBlob(localPath, hash, "")
+}
+
+// linkBlob moves the fully written tmp file to the blob of the hash unless the blob already exists,
+// then links the cached path to the blob
+func (g *GDrive) linkBlob(localPath, hash, tmp string) error {
+	blob := g.blobPath(hash)
+	err := g.mkdirAll(filepath.Dir(blob))
+	if err != nil {
+		return err
+	}
+	if tmp != "" {
+		if _, err := os.Stat(blob); os.IsNotExist(err) {
+			err = os.Rename(tmp, blob)
+			if err != nil {
+				os.Remove(tmp)
+				return err
+			}
+		} else {
+			os.Remove(tmp)
+		}
+	}
+	// never write through an existing link, other paths may share its blob
+	err = os.Remove(localPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(blob, localPath)
+}
+
+// removeLocal removes the cached file, its blob is removed once no dao row references the content anymore.
+// The dao row of the file must already be deleted.
+func (g *GDrive) removeLocal(ctx context.Context, fileInfo FileInfo) error {
+	err := g.removeSegments(fileInfo.Filepath)
+	if err != nil {
+		return err
+	}
+	g.setPlaceholder(fileInfo.Filepath, false)
+	err = os.Remove(g.localFullPath(fileInfo.Filepath))
+	if err != nil {
+		return err
+	}
+	if fileInfo.ContentHash == "" {
+		return nil
+	}
+	// without a dao the blob is unlinked right away, the other paths keep their own links to the content
+	if g.dao != nil {
+		refs, err := g.dao.CountByContentHash(ctx, fileInfo.ContentHash)
+		if err != nil {
+			return err
+		}
+		if refs > 0 {
+			return nil
+		}
+	}
+	err = os.Remove(g.blobPath(fileInfo.ContentHash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package gdrive
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the source of time for LastAccess and eviction decisions, set it in Config.Clock
+// to share a consistent time across hosts or to control time in tests
+type Clock interface {
+	Now() time.Time
+}
+
+func (g *GDrive) now() time.Time {
+	if g.config.Clock == nil {
+		return time.Now()
+	}
+	return g.config.Clock.Now()
+}
+
+// clockSkew returns how far the newest LastAccess of the dao is ahead of the clock, zero when it is not
+func (g *GDrive) clockSkew(ctx context.Context) (time.Duration, error) {
+	if g.dao == nil {
+		return 0, nil
+	}
+	newest, err := g.dao.LatestAccess(ctx)
+	if err != nil || newest.IsZero() {
+		return 0, err
+	}
+	if skew := newest.Sub(g.now()); skew > 0 {
+		return skew, nil
+	}
+	return 0, nil
+}
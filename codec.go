@@ -0,0 +1,37 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+const fileInfoCodecVersion byte = 1
+
+var ErrCodecVersion = errors.New("unsupported file info encoding version")
+
+// FileInfoCodec is the shared FileInfo encoding for custom dao implementations.
+// The first byte is the format version followed by a gob encoding, which tolerates added and removed fields.
+type FileInfoCodec struct{}
+
+func (FileInfoCodec) Encode(fileInfo FileInfo) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{fileInfoCodecVersion})
+	err := gob.NewEncoder(buf).Encode(&fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (FileInfoCodec) Decode(b []byte) (FileInfo, error) {
+	fileInfo := FileInfo{}
+	if len(b) == 0 {
+		return fileInfo, fmt.Errorf("empty data: %w", ErrCodecVersion)
+	}
+	if b[0] != fileInfoCodecVersion {
+		return fileInfo, fmt.Errorf("version %d: %w", b[0], ErrCodecVersion)
+	}
+	err := gob.NewDecoder(bytes.NewReader(b[1:])).Decode(&fileInfo)
+	return fileInfo, err
+}
@@ -0,0 +1,26 @@
+package gdrive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileInfoCodec(t *testing.T) {
+	codec := FileInfoCodec{}
+	fileInfo := FileInfo{FileID: "id1", LastAccess: time.Now().UTC().Round(0), Filepath: "folder/a.txt", Size: 10,
+		MimeType: "text/plain", Description: "desc", Version: 3, Priority: -1}
+	b, err := codec.Encode(fileInfo)
+	require.NoError(t, err)
+
+	decoded, err := codec.Decode(b)
+	require.NoError(t, err)
+	require.Equal(t, fileInfo, decoded)
+
+	b[0] = 99
+	_, err = codec.Decode(b)
+	require.ErrorIs(t, err, ErrCodecVersion)
+	_, err = codec.Decode(nil)
+	require.ErrorIs(t, err, ErrCodecVersion)
+}
@@ -0,0 +1,39 @@
+package gdrive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// compressComment marks the gzip header of content compressed by Config.Compress, so it is inflated on read
+// even after Compress is turned off while a gzip file stored by the user is left as is
+const compressComment = "gdrive"
+
+func compress(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Comment = compressComment
+	_, err := zw.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// inflate returns the content of compressed bytes, any other bytes are returned unchanged
+func inflate(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		return b, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil || zr.Comment != compressComment {
+		return b, nil
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,159 @@
+package gdrive
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrImmutableConfig = errors.New("config field can not be changed at runtime")
+
+const defaultEvictionInterval = time.Minute
+
+// ConfigPatch holds the config values that can be changed while running, nil fields are left unchanged
+type ConfigPatch struct {
+	TotalMaxSize        *int64
+	MaxFileCount        *int
+	EvictionTargetBytes *int64
+	EvictionBatchSize   *int
+	EvictionInterval    *time.Duration
+	DownloadConcurrency *int
+	UploadConcurrency   *int
+	MaxRetries          *int
+
+	// the new limits apply to the requests started after the update
+	MaxConcurrentAPICalls *int
+	RequestsPerSecond     *float64
+
+	// immutable, a patch setting them is rejected
+	LocalFolderRoot  *string
+	RemoteFolderRoot *string
+}
+
+// UpdateConfig applies the patch and lets the background worker pick up the new interval and batch size
+func (g *GDrive) UpdateConfig(patch ConfigPatch) error {
+	if patch.LocalFolderRoot != nil || patch.RemoteFolderRoot != nil {
+		return ErrImmutableConfig
+	}
+
+	g.configMut.Lock()
+	if patch.TotalMaxSize != nil {
+		g.config.TotalMaxSize = *patch.TotalMaxSize
+	}
+	if patch.MaxFileCount != nil {
+		g.config.MaxFileCount = *patch.MaxFileCount
+	}
+	if patch.EvictionTargetBytes != nil {
+		g.config.EvictionTargetBytes = *patch.EvictionTargetBytes
+	}
+	if patch.EvictionBatchSize != nil {
+		g.config.EvictionBatchSize = *patch.EvictionBatchSize
+	}
+	if patch.EvictionInterval != nil {
+		g.config.EvictionInterval = *patch.EvictionInterval
+	}
+	if patch.DownloadConcurrency != nil {
+		g.config.DownloadConcurrency = *patch.DownloadConcurrency
+	}
+	if patch.UploadConcurrency != nil {
+		g.config.UploadConcurrency = *patch.UploadConcurrency
+	}
+	if patch.MaxRetries != nil {
+		g.config.MaxRetries = *patch.MaxRetries
+	}
+	if patch.MaxConcurrentAPICalls != nil {
+		g.config.MaxConcurrentAPICalls = *patch.MaxConcurrentAPICalls
+		g.apiSem = newAPISlots(g.config.MaxConcurrentAPICalls)
+	}
+	if patch.RequestsPerSecond != nil {
+		g.config.RequestsPerSecond = *patch.RequestsPerSecond
+		if g.apiLimiter != nil {
+			g.apiLimiter.SetLimit(requestRate(g.config.RequestsPerSecond))
+		}
+	}
+	g.configMut.Unlock()
+
+	select {
+	case g.configChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// the mutable config values must only be read through these accessors
+
+func (g *GDrive) totalMaxSize() int64 {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	return g.config.TotalMaxSize
+}
+
+func (g *GDrive) maxFileCount() int {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	return g.config.MaxFileCount
+}
+
+// evictionTarget returns the size eviction frees down to, the max size unless a lower target is set
+func (g *GDrive) evictionTarget(maxSize int64) int64 {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	if g.config.EvictionTargetBytes > 0 && g.config.EvictionTargetBytes < maxSize {
+		return g.config.EvictionTargetBytes
+	}
+	return maxSize
+}
+
+func (g *GDrive) evictionBatchSize() int {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	if g.config.EvictionBatchSize > 0 {
+		return g.config.EvictionBatchSize
+	}
+	return defaultEvictionBatchSize
+}
+
+func (g *GDrive) evictionInterval() time.Duration {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	if g.config.EvictionInterval > 0 {
+		return g.config.EvictionInterval
+	}
+	return defaultEvictionInterval
+}
+
+func (g *GDrive) downloadConcurrency() int {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	if g.config.DownloadConcurrency > 0 {
+		return g.config.DownloadConcurrency
+	}
+	return defaultDownloadConcurrency
+}
+
+func (g *GDrive) uploadConcurrency() int {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	if g.config.UploadConcurrency > 0 {
+		return g.config.UploadConcurrency
+	}
+	return defaultUploadConcurrency
+}
+
+// remoteFolderRoot is changed by RenameRemoteRoot
+func (g *GDrive) remoteFolderRoot() string {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	return g.config.RemoteFolderRoot
+}
+
+func (g *GDrive) maxRetries() int {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	if g.config.MaxRetries < 0 {
+		return 0
+	}
+	if g.config.MaxRetries == 0 {
+		return defaultMaxRetries
+	}
+	return g.config.MaxRetries
+}
@@ -0,0 +1,99 @@
+package gdrive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrDecrypt = errors.New("unable to decrypt file, the encryption key may be wrong")
+
+// newAEAD creates the AES-256-GCM cipher of Config.EncryptionKey, nil when encryption is disabled
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encodeContent turns the file bytes into the bytes stored locally and on google drive,
+// compressed first since encrypted bytes do not compress
+func (g *GDrive) encodeContent(b []byte) ([]byte, error) {
+	if g.config.Compress {
+		var err error
+		b, err = compress(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if g.aead == nil {
+		return b, nil
+	}
+	// a random nonce per file is prepended to the ciphertext
+	nonce := make([]byte, g.aead.NonceSize(), g.aead.NonceSize()+len(b)+g.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return g.aead.Seal(nonce, nonce, b, nil), nil
+}
+
+// decodeContent returns the file bytes of the stored bytes
+func (g *GDrive) decodeContent(b []byte) ([]byte, error) {
+	if g.aead != nil {
+		if len(b) < g.aead.NonceSize() {
+			return nil, ErrDecrypt
+		}
+		var err error
+		b, err = g.aead.Open(nil, b[:g.aead.NonceSize()], b[g.aead.NonceSize():], nil)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+	}
+	return inflate(b)
+}
+
+// encodesContent reports whether the stored bytes differ from the file bytes, the streaming paths then
+// go through the whole file in memory
+func (g *GDrive) encodesContent() bool {
+	return g.aead != nil || g.config.Compress
+}
+
+// localContentSize returns the file size of a local file of the given stored size,
+// compressed files are read to find it
+func (g *GDrive) localContentSize(rel string, stored int64) (int64, error) {
+	if !g.config.Compress {
+		if g.aead == nil {
+			return stored, nil
+		}
+		return stored - int64(g.aead.NonceSize()+g.aead.Overhead()), nil
+	}
+	b, err := os.ReadFile(g.localFullPath(rel))
+	if err != nil {
+		return 0, err
+	}
+	b, err = g.decodeContent(b)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
+
+// storedSize is the FileInfo.StoredSize of a file, 0 when it is stored as is
+func storedSize(size, stored int64) int64 {
+	if size == stored {
+		return 0
+	}
+	return stored
+}
@@ -9,6 +9,28 @@ type Dao interface {
 	InsertOrUpdate(ctx context.Context, fileInfo *FileInfo) error
 	Touch(ctx context.Context, filepathName string, date time.Time) error
 	Delete(ctx context.Context, filepathName string) error
+	// Get returns the FileInfo of the path, ErrNotFound when it is missing
+	Get(ctx context.Context, filepathName string) (*FileInfo, error)
+	// TotalSize returns the sum of FileInfo.DiskSize, the bytes counted against Config.TotalMaxSize
 	TotalSize(ctx context.Context) (int64, error)
+	// LatestAccess returns the newest LastAccess of all files, the zero time when there is none
+	LatestAccess(ctx context.Context) (time.Time, error)
+	// Count returns the number of cached files
+	Count(ctx context.Context) (int, error)
 	QueryOldest(ctx context.Context, limit int) ([]FileInfo, error)
+	// QueryOldestAfter returns up to limit files after the cursor in eviction order: lower priorities first, then
+	// the least recently accessed, then by path. A nil cursor starts at the first file, the last returned file
+	// is the cursor of the next page.
+	QueryOldestAfter(ctx context.Context, cursor *FileInfo, limit int) ([]FileInfo, error)
+	// QueryExpired returns every file last accessed before the given time
+	QueryExpired(ctx context.Context, before time.Time) ([]FileInfo, error)
+	// QueryByPrefix returns every file whose path starts with the prefix, an empty prefix returns all files
+	QueryByPrefix(ctx context.Context, prefix string) ([]FileInfo, error)
+	SizeByMimeType(ctx context.Context) (map[string]int64, error)
+	// CountByContentHash returns the number of files whose FileInfo.ContentHash is the hash
+	CountByContentHash(ctx context.Context, hash string) (int, error)
+	SetPriority(ctx context.Context, filepathName string, priority int) error
+	// Rename moves the file to newPath keeping the rest of its FileInfo, it fails with ErrNotFound when oldPath is
+	// missing and ErrFileExist when newPath is taken
+	Rename(ctx context.Context, oldPath, newPath string) error
 }
@@ -0,0 +1,468 @@
+package gdrive
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+const fakeCredential = `{"installed":{"client_id":"fake","client_secret":"fake","redirect_uris":["http://localhost"],
+"auth_uri":"http://localhost/auth","token_uri":"http://localhost/token"}}`
+
+// fakeDrive is a minimal in memory implementation of the drive v3 REST api used by the package
+type fakeDrive struct {
+	mut    sync.Mutex
+	files  map[string]*fakeFile
+	nextID int
+	calls  map[string]int
+
+	sessions        map[string]*fakeSession
+	failChunk       int // fail the nth resumable chunk request, 0 disables
+	dropChunk       int // commit the nth resumable chunk but drop the connection before answering, 0 disables
+	chunkCount      int
+	receivedBytes   int
+	downloadedBytes int
+	corruptUploads  bool
+	quota           int64    // total content bytes accepted before storageQuotaExceeded, 0 is unlimited
+	rejectNames     []string // creates of these names fail with a bad request
+	lostCreates     int      // the next creates store the file but answer with a server error
+
+	// when set, downloads signal downloadStarted and wait for downloadGate
+	downloadStarted chan struct{}
+	downloadGate    chan struct{}
+}
+
+type fakeSession struct {
+	meta   drive.File
+	fileID string
+	size   int64
+	data   []byte
+}
+
+type fakeFile struct {
+	meta    drive.File
+	content []byte
+}
+
+func newFakeDrive() *fakeDrive {
+	return &fakeDrive{
+		files:    map[string]*fakeFile{},
+		calls:    map[string]int{},
+		sessions: map[string]*fakeSession{},
+	}
+}
+
+func (f *fakeDrive) callCount(name string) int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.calls[name]
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.downloadGate != nil && r.URL.Query().Get("alt") == "media" {
+		f.downloadStarted <- struct{}{}
+		<-f.downloadGate
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	p := r.URL.Path
+	if query := r.URL.Query(); query.Get("supportsAllDrives") == "true" {
+		f.calls["allDrives"]++
+		if query.Get("corpora") == "drive" && query.Get("driveId") != "" && query.Get("includeItemsFromAllDrives") == "true" {
+			f.calls["driveList"]++
+		}
+	}
+	switch {
+	case p == "/drive/v3/about":
+		writeFakeJSON(w, &drive.About{User: &drive.User{EmailAddress: "fake@example.com", DisplayName: "Fake"}})
+	case strings.HasPrefix(p, "/upload/drive/v3/files") && r.URL.Query().Get("uploadType") == "resumable":
+		f.calls["session"]++
+		f.startSession(w, r, strings.TrimPrefix(strings.TrimPrefix(p, "/upload/drive/v3/files"), "/"))
+	case strings.HasPrefix(p, "/upload/session/") && r.Method == http.MethodPut:
+		f.putSession(w, r, strings.TrimPrefix(p, "/upload/session/"))
+	case p == "/drive/v3/files" && r.Method == http.MethodGet:
+		f.calls["list"]++
+		f.list(w, r)
+	case (p == "/drive/v3/files" || p == "/upload/drive/v3/files") && r.Method == http.MethodPost:
+		f.calls["create"]++
+		f.create(w, r)
+	case strings.HasPrefix(p, "/upload/drive/v3/files/") && r.Method == http.MethodPatch,
+		strings.HasPrefix(p, "/drive/v3/files/") && r.Method == http.MethodPatch:
+		f.calls["update"]++
+		f.update(w, r, p[strings.LastIndex(p, "/")+1:])
+	case strings.HasPrefix(p, "/drive/v3/files/") && strings.HasSuffix(p, "/export") && r.Method == http.MethodGet:
+		f.calls["export"]++
+		file, ok := f.files[strings.TrimSuffix(strings.TrimPrefix(p, "/drive/v3/files/"), "/export")]
+		if !ok {
+			writeFakeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		w.Header().Set("Content-Type", r.URL.Query().Get("mimeType"))
+		fmt.Fprintf(w, "%s:%s", r.URL.Query().Get("mimeType"), file.content)
+	case strings.HasPrefix(p, "/drive/v3/files/") && r.Method == http.MethodGet:
+		id := strings.TrimPrefix(p, "/drive/v3/files/")
+		file, ok := f.files[id]
+		if !ok {
+			writeFakeError(w, http.StatusNotFound, "notFound")
+			return
+		}
+		if r.URL.Query().Get("alt") == "media" {
+			f.calls["download"]++
+			content := file.content
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+				if end >= len(content) {
+					end = len(content) - 1
+				}
+				content = content[start : end+1]
+				w.WriteHeader(http.StatusPartialContent)
+			}
+			f.downloadedBytes += len(content)
+			w.Write(content)
+			return
+		}
+		f.calls["get"]++
+		writeFakeJSON(w, &file.meta)
+	case strings.HasPrefix(p, "/drive/v3/files/") && r.Method == http.MethodDelete:
+		f.calls["delete"]++
+		f.delete(strings.TrimPrefix(p, "/drive/v3/files/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeError(w, http.StatusNotFound, "notFound")
+	}
+}
+
+var (
+	fakeNameQuery     = regexp.MustCompile(`name\s*=\s*'((?:[^'\\]|\\.)*)'`)
+	fakeParentQuery   = regexp.MustCompile(`'((?:[^'\\]|\\.)*)'\s+in\s+parents`)
+	fakeMimeQuery     = regexp.MustCompile(`mimeType\s*(!?=)\s*'((?:[^'\\]|\\.)*)'`)
+	fakeTrashedQuery  = regexp.MustCompile(`trashed\s*=\s*false`)
+	fakeContainsQuery = regexp.MustCompile(`name\s+contains\s+'((?:[^'\\]|\\.)*)'`)
+)
+
+func unescapeFakeQuery(s string) string {
+	return strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(s)
+}
+
+func (f *fakeDrive) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	res := &drive.FileList{Files: []*drive.File{}}
+	for _, file := range f.files {
+		if m := fakeNameQuery.FindStringSubmatch(q); m != nil && file.meta.Name != unescapeFakeQuery(m[1]) {
+			continue
+		}
+		if m := fakeParentQuery.FindStringSubmatch(q); m != nil && !containsString(file.meta.Parents, unescapeFakeQuery(m[1])) {
+			continue
+		}
+		if m := fakeMimeQuery.FindStringSubmatch(q); m != nil && (file.meta.MimeType == unescapeFakeQuery(m[2])) != (m[1] == "=") {
+			continue
+		}
+		if m := fakeContainsQuery.FindStringSubmatch(q); m != nil && !strings.Contains(file.meta.Name, unescapeFakeQuery(m[1])) {
+			continue
+		}
+		if fakeTrashedQuery.MatchString(q) && file.meta.Trashed {
+			continue
+		}
+		meta := file.meta
+		res.Files = append(res.Files, &meta)
+	}
+	pageSize := 0
+	if v := r.URL.Query().Get("pageSize"); v != "" {
+		// google drive only accepts 1 to 1000
+		pageSize, _ = strconv.Atoi(v)
+		if pageSize < 1 || pageSize > 1000 {
+			writeFakeError(w, http.StatusBadRequest, "invalid")
+			return
+		}
+	}
+	sort.Slice(res.Files, func(i, j int) bool { return res.Files[i].Name < res.Files[j].Name })
+	// the page token is the offset of the page
+	offset, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	if offset > len(res.Files) {
+		offset = len(res.Files)
+	}
+	res.Files = res.Files[offset:]
+	if pageSize > 0 && len(res.Files) > pageSize {
+		res.Files = res.Files[:pageSize]
+		res.NextPageToken = strconv.Itoa(offset + pageSize)
+	}
+	writeFakeJSON(w, res)
+}
+
+func (f *fakeDrive) create(w http.ResponseWriter, r *http.Request) {
+	meta, content, err := readFakeUpload(r)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.nextID++
+	meta.Id = fmt.Sprintf("id%d", f.nextID)
+	if meta.MimeType == "" {
+		meta.MimeType = "application/octet-stream"
+	}
+	if f.overQuota(int64(len(content))) {
+		writeFakeError(w, http.StatusForbidden, "storageQuotaExceeded")
+		return
+	}
+	if containsString(f.rejectNames, meta.Name) {
+		writeFakeError(w, http.StatusBadRequest, "badRequest")
+		return
+	}
+	file := &fakeFile{meta: *meta}
+	if f.corruptUploads && len(content) > 0 {
+		content = content[1:]
+	}
+	file.setContent(content)
+	f.files[meta.Id] = file
+	if f.lostCreates > 0 {
+		f.lostCreates--
+		writeFakeError(w, http.StatusInternalServerError, "backendError")
+		return
+	}
+	writeFakeJSON(w, &file.meta)
+}
+
+func (f *fakeDrive) update(w http.ResponseWriter, r *http.Request, id string) {
+	file, ok := f.files[id]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	meta, content, err := readFakeUpload(r)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if content != nil && f.overQuota(int64(len(content))-int64(len(file.content))) {
+		writeFakeError(w, http.StatusForbidden, "storageQuotaExceeded")
+		return
+	}
+	if meta.Name != "" {
+		file.meta.Name = meta.Name
+	}
+	if meta.Description != "" {
+		file.meta.Description = meta.Description
+	}
+	if remove := r.URL.Query().Get("removeParents"); remove != "" {
+		parents := []string{}
+		for _, parent := range file.meta.Parents {
+			if !containsString(strings.Split(remove, ","), parent) {
+				parents = append(parents, parent)
+			}
+		}
+		file.meta.Parents = parents
+	}
+	if add := r.URL.Query().Get("addParents"); add != "" {
+		file.meta.Parents = append(file.meta.Parents, strings.Split(add, ",")...)
+	}
+	if content != nil {
+		file.setContent(content)
+	}
+	writeFakeJSON(w, &file.meta)
+}
+
+func (f *fakeDrive) startSession(w http.ResponseWriter, r *http.Request, fileID string) {
+	meta := drive.File{}
+	err := json.NewDecoder(r.Body).Decode(&meta)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	size, _ := strconv.ParseInt(r.Header.Get("X-Upload-Content-Length"), 10, 64)
+	replaced := int64(0)
+	if file, ok := f.files[fileID]; ok {
+		replaced = int64(len(file.content))
+	}
+	if f.overQuota(size - replaced) {
+		writeFakeError(w, http.StatusForbidden, "storageQuotaExceeded")
+		return
+	}
+	f.nextID++
+	sid := fmt.Sprintf("session%d", f.nextID)
+	f.sessions[sid] = &fakeSession{meta: meta, fileID: fileID, size: size}
+	w.Header().Set("Location", "http://"+r.Host+"/upload/session/"+sid)
+}
+
+func (f *fakeDrive) putSession(w http.ResponseWriter, r *http.Request, sid string) {
+	session, ok := f.sessions[sid]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body) > 0 {
+		f.chunkCount++
+		if f.chunkCount == f.failChunk {
+			writeFakeError(w, http.StatusServiceUnavailable, "backendError")
+			return
+		}
+		var start int64
+		fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-", &start)
+		if start != int64(len(session.data)) {
+			writeFakeError(w, http.StatusBadRequest, "invalid offset")
+			return
+		}
+		session.data = append(session.data, body...)
+		f.receivedBytes += len(body)
+		if f.chunkCount == f.dropChunk {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+	if int64(len(session.data)) < session.size {
+		if len(session.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	file, ok := f.files[session.fileID]
+	if !ok {
+		f.nextID++
+		file = &fakeFile{meta: session.meta}
+		file.meta.Id = fmt.Sprintf("id%d", f.nextID)
+		if file.meta.MimeType == "" {
+			file.meta.MimeType = "application/octet-stream"
+		}
+		f.files[file.meta.Id] = file
+	}
+	file.setContent(session.data)
+	delete(f.sessions, sid)
+	writeFakeJSON(w, &file.meta)
+}
+
+func (f *fakeDrive) overQuota(extra int64) bool {
+	if f.quota <= 0 {
+		return false
+	}
+	used := extra
+	for _, file := range f.files {
+		used += int64(len(file.content))
+	}
+	return used > f.quota
+}
+
+func (f *fakeDrive) delete(id string) {
+	delete(f.files, id)
+	for childID, file := range f.files {
+		if containsString(file.meta.Parents, id) {
+			f.delete(childID)
+		}
+	}
+}
+
+func (file *fakeFile) setContent(content []byte) {
+	file.content = content
+	file.meta.Version++
+	file.meta.Size = int64(len(content))
+	sum := md5.Sum(content)
+	file.meta.Md5Checksum = hex.EncodeToString(sum[:])
+}
+
+func readFakeUpload(r *http.Request) (*drive.File, []byte, error) {
+	meta := &drive.File{}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		err = json.NewDecoder(r.Body).Decode(meta)
+		if err == io.EOF {
+			err = nil
+		}
+		return meta, nil, err
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = json.NewDecoder(part).Decode(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	part, err = reader.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := io.ReadAll(part)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.MimeType == "" {
+		meta.MimeType = part.Header.Get("Content-Type")
+	}
+	return meta, content, nil
+}
+
+func writeFakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeFakeError(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q,"errors":[{"reason":%q}]}}`, code, reason, reason)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// newFakeInstance creates an initialized instance backed by a fake drive server and a temporary local folder
+func newFakeInstance(t *testing.T, cfg *Config, dao Dao) (*GDrive, *fakeDrive) {
+	t.Helper()
+	fake := newFakeDrive()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	if cfg.LocalFolderRoot == "" {
+		cfg.LocalFolderRoot = t.TempDir()
+	}
+	if cfg.RemoteFolderRoot == "" {
+		cfg.RemoteFolderRoot = "fake"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	instance, err := New(ctx, []byte(fakeCredential), cfg, dao, &oauth2.Token{AccessToken: "fake"},
+		option.WithEndpoint(srv.URL+"/drive/v3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance, fake
+}
@@ -0,0 +1,112 @@
+package gdrive
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// remoteEntry is a file found while listing the remote folder, with its cached path
+type remoteEntry struct {
+	Path string
+	File *drive.File
+}
+
+// remoteLocation returns the google drive folder and the name of the cached path.
+// With Config.UseNativeFolders the folders of the path are created when create is set,
+// otherwise a missing folder returns an empty folder id.
+func (g *GDrive) remoteLocation(ctx context.Context, filePathName string, create bool) (folderID, name string, err error) {
+	if !g.config.UseNativeFolders {
+		return g.parentFolderID, g.convertToGDrive(filePathName), nil
+	}
+	dir, name := path.Split(filePathName)
+	folderID, err = g.resolveRemoteFolder(ctx, strings.TrimSuffix(dir, "/"), create)
+	return folderID, name, err
+}
+
+// ensureRemoteFolder returns the id of the google drive folder of the relative dir, creating the missing folders
+func (g *GDrive) ensureRemoteFolder(ctx context.Context, relDir string) (string, error) {
+	return g.resolveRemoteFolder(ctx, relDir, true)
+}
+
+func (g *GDrive) resolveRemoteFolder(ctx context.Context, relDir string, create bool) (string, error) {
+	// one resolution at a time, so concurrent stores never create the same folder twice
+	g.folderMut.Lock()
+	defer g.folderMut.Unlock()
+	return g.resolveRemoteFolderLocked(ctx, relDir, create)
+}
+
+func (g *GDrive) resolveRemoteFolderLocked(ctx context.Context, relDir string, create bool) (string, error) {
+	if relDir == "" || relDir == "." {
+		return g.parentFolderID, nil
+	}
+	if folderID, ok := g.remoteFolders[relDir]; ok {
+		return folderID, nil
+	}
+	parentID, err := g.resolveRemoteFolderLocked(ctx, path.Dir(relDir), create)
+	if err != nil || parentID == "" {
+		return "", err
+	}
+	name := path.Base(relDir)
+	existing, err := g.findChild(ctx, parentID, name, true)
+	if err != nil {
+		return "", err
+	}
+	var folderID string
+	if existing != nil {
+		folderID = existing.Id
+	} else if create {
+		res, err := g.withRetryCreate(ctx, nil, func() (*drive.File, error) {
+			return g.findChild(ctx, parentID, name, true)
+		}, func() (*drive.File, error) {
+			return g.filesCreate(&drive.File{
+				Name:     name,
+				MimeType: "application/vnd.google-apps.folder",
+				Parents:  []string{parentID},
+			}).Fields("id").Context(ctx).Do()
+		})
+		if err != nil {
+			return "", err
+		}
+		folderID = res.Id
+	} else {
+		return "", nil
+	}
+	g.remoteFolders[relDir] = folderID
+	return folderID, nil
+}
+
+// findChild returns the file or folder of the name in the google drive folder, nil when there is none
+func (g *GDrive) findChild(ctx context.Context, parentID, name string, folder bool) (*drive.File, error) {
+	mimeType := "mimeType != 'application/vnd.google-apps.folder'"
+	if folder {
+		mimeType = "mimeType = 'application/vnd.google-apps.folder'"
+	}
+	var files *drive.FileList
+	err := g.withRetry(ctx, func() (err error) {
+		files, err = g.filesList().
+			Q(fmt.Sprintf("name = '%s' and '%s' in parents and %s and trashed = false",
+				escapeDriveQuery(name), escapeDriveQuery(parentID), mimeType)).
+			Fields(listFields...).
+			Context(ctx).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files.Files) == 0 {
+		return nil, nil
+	}
+	return files.Files[0], nil
+}
+
+// resetRemoteFolders forgets the resolved folders, needed when the parent folder changes
+func (g *GDrive) resetRemoteFolders() {
+	g.folderMut.Lock()
+	defer g.folderMut.Unlock()
+	g.remoteFolders = map[string]string{}
+}
@@ -3,359 +3,2581 @@ package gdrive
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
+	"mime"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
-var ErrFileExist = errors.New("file exist")
+var (
+	ErrFileExist        = errors.New("file exist")
+	ErrNotAuthenticated = errors.New("not authenticated")
+	ErrFolderNotOwned   = errors.New("folder was not created by this instance")
+	ErrNotFound         = errors.New("file not found")
+	ErrConflict         = errors.New("file was changed on google drive")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrStorageFull      = errors.New("google drive storage is full")
+	ErrEmptyFile        = errors.New("file is empty")
+	ErrStateMismatch    = errors.New("oauth state was not issued by this instance")
+	ErrInvalidRange     = errors.New("range is outside of the file")
+	ErrInvalidPath      = errors.New("path is outside of the cache")
+)
+
+var (
+	uploadFields = []googleapi.Field{"id", "name", "mimeType", "description", "version", "md5Checksum"}
+	listFields   = []googleapi.Field{"nextPageToken", "files(id,name,mimeType,description,version,size,md5Checksum)"}
+)
+
+const folderPrefix = "gdrive-"
+
+const (
+	defaultEvictionBatchSize   = 10
+	defaultDownloadConcurrency = 10
+	defaultUploadConcurrency   = 10
+	maxEvictionRounds          = 100
+	defaultFileMode            = 0600
+	defaultDirMode             = 0700
+	loginStateTTL              = 15 * time.Minute // how long a login url state can be exchanged
+)
+
+// TouchMissingMode controls what TouchFile does when the file is neither cached nor on google drive
+type TouchMissingMode int
+
+const (
+	TouchMissingError       TouchMissingMode = iota // return ErrNotFound
+	TouchMissingIgnore                              // do nothing
+	TouchMissingPlaceholder                         // create an empty local file
+)
+
+// ConflictMode controls what StoreFile does when the path already exists and Replace is not set
+type ConflictMode int
+
+const (
+	ConflictError   ConflictMode = iota // return ErrFileExist
+	ConflictVersion                     // store under the next free suffixed path, see Config.VersionSuffixFormat
+)
+
+const (
+	defaultVersionSuffixFormat = "%s (%d)%s"
+	maxVersionSuffix           = 1000
+	maxListPageSize            = 1000 // largest page size accepted by google drive
+)
 
 type Config struct {
-	LocalFolderRoot  string
-	RemoteFolderRoot string
-	TotalMaxSize     int64 // in bytes
+	LocalFolderRoot     string
+	RemoteFolderRoot    string
+	TotalMaxSize        int64         // in bytes, zero or negative means unlimited
+	MaxFileCount        int           // maximum number of cached files, zero or negative means unlimited
+	EvictionTargetBytes int64         // eviction frees down to this size below TotalMaxSize, default TotalMaxSize
+	EvictionBatchSize   int           // files fetched per eviction query, default 10
+	EvictionInterval    time.Duration // time between eviction checks, default 1 minute
+	EvictionGracePeriod time.Duration // files accessed within this period are not evicted
+	EvictionTimeout     time.Duration // maximum duration of a single eviction pass, 0 is unlimited
+	TTL                 time.Duration // files not accessed for this long are evicted regardless of TotalMaxSize and priority, 0 disables
+	OnTokenRefresh      func(token *oauth2.Token)
+	ProgressFunc        ProgressFunc // called while uploading and downloading files
+	DriveID             string       // shared drive holding the cache, empty uses my drive
+	EncryptionKey       []byte       // 32 bytes AES-256-GCM key encrypting the files locally and on google drive
+	Compress            bool         // gzip the files locally and on google drive
+	Logger              Logger       // receives the log messages, default the standard logrus logger
+	Metrics             Metrics      // receives cache hits, misses, uploads and evictions
+	Scopes              []string     // oauth scopes requested by the login url, default drive.DriveFileScope
+	MaxRetries          int          // retries of failed google drive calls, default 3 and negative to disable
+	DatePartition       string       // time layout like 2006/01/02 used to prefix stored files with the current date
+	FileMode            os.FileMode  // permissions of the cached local files, default 0600
+	DirMode             os.FileMode  // permissions of the created local folders, default 0700
+
+	ResumableThreshold int64  // files of at least this size use resumable uploads, 0 disables
+	UploadChunkSize    int64  // resumable upload chunk size, multiple of 256 KiB, default 8 MiB
+	UploadStateFile    string // file used to persist resumable upload sessions across restarts
+
+	TouchMissing        TouchMissingMode
+	DownloadConcurrency int    // concurrent downloads, default 10
+	UploadConcurrency   int    // concurrent uploads of UploadAll, default 10
+	SegmentFolder       string // enables caching of DownloadRange segments in this folder
+	AccessRecorder      AccessRecorder
+
+	MaxConcurrentAPICalls int     // ceiling of in-flight google drive requests across all operations, 0 is unlimited
+	RequestsPerSecond     float64 // rate of google drive requests across all operations, 0 is unlimited
+	DefaultMimeType       string  // mime type of uploads whose type can not be detected
+	VerifyAfterUpload     bool    // compare the remote checksum after every StoreFile upload
+	EvictRemoteOnFull     bool    // delete the least recently used files from google drive and retry once when the drive is full
+	ContentAddressedLocal bool    // store identical local content once, cached paths share it through hard links
+	AuditLogger           AuditLogger
+	EvictionPolicy        EvictionPolicy // default LRUPolicy
+	DownloadParts         int            // download large files in up to this many parallel byte ranges, 0 or 1 disables
+
+	Clock               Clock // source of time for LastAccess and eviction, default the system clock
+	ConflictMode        ConflictMode
+	VersionSuffixFormat string // layout receiving the path without extension, the version and the extension, default "%s (%d)%s"
+	RejectEmpty         bool   // StoreFile fails with ErrEmptyFile on zero byte files
+
+	// google native mime type to export mime type, like application/vnd.google-apps.document to application/pdf.
+	// Native files are cached in their exported form.
+	ExportMap map[string]string
+
+	// store dir/file.txt as file.txt inside a dir folder instead of a dir#file.txt file in the parent folder.
+	// Existing caches keep using the flat names when it is not set.
+	UseNativeFolders bool
 }
 
 type GDrive struct {
 	ctx            context.Context
+	cancel         context.CancelFunc // cancels ctx on Close
+	workerDone     chan struct{}      // closed when Start returns
 	oauthConfig    *oauth2.Config
+	aead           cipher.AEAD // encrypts the stored files with Config.EncryptionKey
 	config         *Config
 	dao            Dao
+	authMut        sync.RWMutex // guards the client fields, a token refresh swaps them while operations run
 	httpClient     *http.Client
 	driveService   *drive.Service
+	tokenSource    oauth2.TokenSource
+	clientOptions  []option.ClientOption
+	exchangeOpts   []option.ClientOption // options of the last exchange, kept for the services of refreshed tokens
 	parentFolderID string
+	createdParent  bool // parent folder was created by Init instead of found
+	mut            sync.Mutex
+	configMut      sync.RWMutex
+	configChanged  chan struct{}
+	apiSem         chan struct{}
+	apiLimiter     *rate.Limiter
+	accountOnce    sync.Once
+	pinned         map[string]struct{}
+	placeholders   map[string]struct{}  // local placeholders of TouchMissingPlaceholder, also flagged in the dao
+	loginStates    map[string]time.Time // expiry of the states issued by the login urls and not exchanged yet
+	downloading    map[string]int       // in-flight downloads per path, never evicted
+	remoteIndex    map[string]*drive.File
+	folderMut      sync.Mutex
+	remoteFolders  map[string]string // relative dir to google drive folder id with Config.UseNativeFolders
+	storeGroup     singleflight.Group
+	storeCalls     map[string]*sharedStore // contexts of the stores shared through storeGroup
+	touchGroup     singleflight.Group      // downloads of TouchFile per path
+	pathLocks      keyedMutex              // serializes store, touch, read and delete of the same path
+	sessions       map[string]*uploadSession
+	sessionsOnce   sync.Once
+	sessionsErr    error
 }
 
-func New(ctx context.Context, credential json.RawMessage, config *Config, dao Dao, token *oauth2.Token) (*GDrive, error) {
-	cfg, err := google.ConfigFromJSON(credential, drive.DriveFileScope)
+// New creates the instance, the client options are passed to the google drive service, e.g. to use a custom endpoint.
+func New(ctx context.Context, credential json.RawMessage, config *Config, dao Dao, token *oauth2.Token, opts ...option.ClientOption) (*GDrive, error) {
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{drive.DriveFileScope}
+	}
+	cfg, err := google.ConfigFromJSON(credential, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(config.EncryptionKey)
 	if err != nil {
 		return nil, err
 	}
-	var httpClient *http.Client
-	var driveService *drive.Service
+	ctx, cancel := context.WithCancel(ctx)
+	g := &GDrive{
+		ctx:           ctx,
+		cancel:        cancel,
+		oauthConfig:   cfg,
+		aead:          aead,
+		config:        config,
+		dao:           dao,
+		pinned:        map[string]struct{}{},
+		placeholders:  map[string]struct{}{},
+		loginStates:   map[string]time.Time{},
+		downloading:   map[string]int{},
+		remoteFolders: map[string]string{},
+		clientOptions: opts,
+		configChanged: make(chan struct{}, 1),
+	}
 	if token != nil {
-		httpClient = cfg.Client(ctx, token)
-		driveService, err = drive.NewService(ctx, option.WithHTTPClient(httpClient))
+		err = g.setToken(token)
 		if err != nil {
+			cancel()
 			return nil, err
 		}
 	}
-	return &GDrive{
-		ctx:          ctx,
-		oauthConfig:  cfg,
-		config:       config,
-		dao:          dao,
-		httpClient:   httpClient,
-		driveService: driveService,
-	}, nil
+	return g, nil
 }
 
 func (g *GDrive) Start() {
-	t := time.NewTimer(time.Minute)
+	done := make(chan struct{})
+	defer close(done)
+	g.mut.Lock()
+	g.workerDone = done
+	g.mut.Unlock()
+
+	if skew, err := g.clockSkew(g.ctx); err == nil && skew > 0 {
+		g.logger().Warnf("newest last access is %s in the future, the clock may be skewed", skew)
+	}
+	// a cache that is already over the limit is evicted right away instead of after the first interval
+	interval := g.evictionInterval()
+	if g.shouldRemove() {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
+			next := g.evictionInterval()
 			if g.shouldRemove() {
-				t.Reset(time.Second)
-			} else {
-				t.Reset(time.Minute)
+				next = time.Second
 			}
+			if next != interval {
+				interval = next
+				t.Reset(interval)
+			}
+		case <-g.configChanged:
+			interval = g.evictionInterval()
+			t.Reset(interval)
 		case <-g.ctx.Done():
 			return
 		}
 	}
 }
 
+// Close stops the background worker of Start, waits for it to return and closes the idle google drive connections.
+// The instance can not be used after Close.
+func (g *GDrive) Close() error {
+	g.cancel()
+	g.mut.Lock()
+	done := g.workerDone
+	g.mut.Unlock()
+	if done != nil {
+		<-done
+	}
+	if client := g.client(); client != nil {
+		client.CloseIdleConnections()
+	}
+	return nil
+}
+
 func (g *GDrive) Init() error {
-	folderName := g.getFolderName(g.config.RemoteFolderRoot)
-	files, err := g.driveService.Files.List().
-		Q(fmt.Sprintf("mimeType = 'application/vnd.google-apps.folder' and name = '%s'", folderName)).
-		Do()
-	if err != nil {
-		return err
+	if g.service() == nil {
+		return ErrNotAuthenticated
 	}
-	found := false
-	for _, f := range files.Files {
-		if len(f.Parents) == 0 {
-			found = true
-			g.parentFolderID = f.Id
-			break
+	g.accountOnce.Do(func() {
+		email, err := g.AccountInfo(g.ctx)
+		if err != nil {
+			g.logger().Warnf("unable to get google drive account info: %v", err)
+			return
 		}
+		g.logger().Infof("using google drive account %s", email)
+	})
+	folderName := g.getFolderName(g.remoteFolderRoot())
+	q := fmt.Sprintf("mimeType = 'application/vnd.google-apps.folder' and name = '%s' and trashed = false", escapeDriveQuery(folderName))
+	if g.config.DriveID != "" {
+		// the root folder lives at the top of the shared drive
+		q += fmt.Sprintf(" and '%s' in parents", escapeDriveQuery(g.config.DriveID))
 	}
-	if !found {
-		res, err := g.driveService.Files.Create(
-			&drive.File{
+	findParent := func() (*drive.File, error) {
+		var files *drive.FileList
+		err := g.withRetry(g.ctx, func() (err error) {
+			files, err = g.filesList().
+				Q(q).
+				Context(g.ctx).
+				Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files.Files {
+			if len(f.Parents) == 0 || g.config.DriveID != "" {
+				return f, nil
+			}
+		}
+		return nil, nil
+	}
+	parent, err := findParent()
+	if err != nil {
+		return err
+	}
+	if parent != nil {
+		g.parentFolderID = parent.Id
+		g.createdParent = false
+	} else {
+		res, err := g.withRetryCreate(g.ctx, nil, findParent, func() (*drive.File, error) {
+			folder := &drive.File{
 				Name:     folderName,
 				MimeType: "application/vnd.google-apps.folder",
-			}).
-			Do()
+			}
+			if g.config.DriveID != "" {
+				folder.Parents = []string{g.config.DriveID}
+			}
+			return g.filesCreate(folder).
+				Context(g.ctx).
+				Do()
+		})
 		if err != nil {
 			return err
 		}
 		g.parentFolderID = res.Id
+		g.createdParent = true
 	}
+	// a new parent folder makes the index and folders of the old one useless
+	g.InvalidateRemoteIndex()
+	g.resetRemoteFolders()
 	return nil
 }
 
-func (g *GDrive) GetLoginURL() string {
-	return g.oauthConfig.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+// MoveRemoteRoot moves the parent folder under another google drive folder, the cached files move along with it
+func (g *GDrive) MoveRemoteRoot(ctx context.Context, newParentID string) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	var current *drive.File
+	err := g.withRetry(ctx, func() (err error) {
+		current, err = g.filesGet(g.parentFolderID).Fields("id", "parents").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return g.withRetry(ctx, func() error {
+		_, err := g.filesUpdate(g.parentFolderID, &drive.File{}).
+			AddParents(newParentID).
+			RemoveParents(strings.Join(current.Parents, ",")).
+			Context(ctx).
+			Do()
+		return err
+	})
 }
 
-func (g *GDrive) ExchangeOauthCode(code string) (*oauth2.Token, error) {
-	token, err := g.oauthConfig.Exchange(g.ctx, code)
-	if err != nil {
-		return nil, err
+// RenameRemoteRoot renames the parent folder to gdrive-<newName> keeping its id and children,
+// Config.RemoteFolderRoot is updated so a later Init resolves the renamed folder
+func (g *GDrive) RenameRemoteRoot(ctx context.Context, newName string) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
 	}
-	g.httpClient = g.oauthConfig.Client(g.ctx, token)
-	g.driveService, err = drive.NewService(g.ctx, option.WithHTTPClient(g.httpClient))
+	err := g.withRetry(ctx, func() error {
+		_, err := g.filesUpdate(g.parentFolderID, &drive.File{Name: g.getFolderName(newName)}).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return token, nil
+	g.configMut.Lock()
+	g.config.RemoteFolderRoot = newName
+	g.configMut.Unlock()
+	return nil
 }
 
-func (g *GDrive) StoreFile(ctx context.Context, fileInsertInfo *FileInsertInfo) error {
-	// check if file exist in local
-	localPath := g.localFullPath(fileInsertInfo.Filepath)
-	_, err := os.Stat(localPath)
-	if err != nil && !os.IsNotExist(err) && !fileInsertInfo.Replace {
-		return ErrFileExist
+// ListManagedFolders lists every folder following the gdrive-<root> naming, including strays left by older bugs
+func (g *GDrive) ListManagedFolders(ctx context.Context) ([]*RemoteFile, error) {
+	if g.service() == nil {
+		return nil, ErrNotAuthenticated
 	}
-
-	driveFile := g.getFileInCloud(ctx, fileInsertInfo.Filepath)
-	if driveFile != nil && !fileInsertInfo.Replace {
-		return ErrFileExist
+	retVal := []*RemoteFile{}
+	pageToken := ""
+	for {
+		var files *drive.FileList
+		err := g.withRetry(ctx, func() (err error) {
+			files, err = g.filesList().
+				Q(fmt.Sprintf("mimeType = 'application/vnd.google-apps.folder' and name contains '%s' and trashed = false", escapeDriveQuery(folderPrefix))).
+				Fields("nextPageToken", "files(id,name,mimeType,size,modifiedTime,parents)").
+				PageToken(pageToken).
+				Context(ctx).
+				Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files.Files {
+			// contains is a prefix match per word, check the actual prefix
+			if strings.HasPrefix(f.Name, folderPrefix) {
+				retVal = append(retVal, newRemoteFile(f))
+			}
+		}
+		if files.NextPageToken == "" {
+			return retVal, nil
+		}
+		pageToken = files.NextPageToken
 	}
+}
 
-	// store it to google drive
-	reader := bytes.NewReader(fileInsertInfo.FileBytes)
-	res, err := g.uploadToCloud(ctx, fileInsertInfo.Filepath, reader, fileInsertInfo.Replace)
+// Purge deletes a managed folder with everything inside it.
+// Folders that do not follow the package naming, or the parent folder when it was not created by this instance,
+// are refused with ErrFolderNotOwned unless force is set.
+func (g *GDrive) Purge(ctx context.Context, folderID string, force bool) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	if !force {
+		if folderID == g.parentFolderID && !g.createdParent {
+			return ErrFolderNotOwned
+		}
+		var folder *drive.File
+		err := g.withRetry(ctx, func() (err error) {
+			folder, err = g.filesGet(folderID).Fields("id", "name").Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(folder.Name, folderPrefix) {
+			return ErrFolderNotOwned
+		}
+	}
+	err := g.withRetry(ctx, func() error {
+		return g.filesDelete(folderID).Context(ctx).Do()
+	})
 	if err != nil {
 		return err
 	}
+	g.audit(ctx, AuditPurge, "", folderID, 0)
+	return nil
+}
 
-	// store it to local folder
-	err = g.storeFileToLocal(ctx, fileInsertInfo.Filepath, fileInsertInfo.FileBytes)
-	if err != nil {
+// VerifyParent checks the parent folder still exists on google drive and recreates it when it was deleted or trashed
+func (g *GDrive) VerifyParent(ctx context.Context) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	var folder *drive.File
+	err := g.withRetry(ctx, func() (err error) {
+		folder, err = g.filesGet(g.parentFolderID).Fields("id", "trashed").Context(ctx).Do()
+		return err
+	})
+	var apiErr *googleapi.Error
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound) {
 		return err
 	}
+	if err == nil && !folder.Trashed {
+		return nil
+	}
+	g.logger().Warnf("parent folder %s is gone from google drive, recreating it", g.parentFolderID)
+	return g.Init()
+}
 
-	if g.dao != nil {
-		g.dao.InsertOrUpdate(ctx, &FileInfo{FileID: res.Id, LastAccess: time.Now(), Filepath: fileInsertInfo.Filepath,
-			Size: int64(len(fileInsertInfo.FileBytes)), MimeType: res.MimeType})
+// AccountInfo returns the email address of the google account owning the token
+func (g *GDrive) AccountInfo(ctx context.Context) (string, error) {
+	if g.service() == nil {
+		return "", ErrNotAuthenticated
+	}
+	var about *drive.About
+	err := g.withRetry(ctx, func() (err error) {
+		about, err = g.service().About.Get().Fields("user(emailAddress,displayName)").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", err
 	}
+	if about.User == nil {
+		return "", errors.New("account user not returned")
+	}
+	return about.User.EmailAddress, nil
+}
 
-	return nil
+func (g *GDrive) GetLoginURL() string {
+	return g.GetLoginURLWithState("state-token")
 }
 
-func (g *GDrive) TouchFile(ctx context.Context, filePathName string) error {
-	localPath := g.localFullPath(filePathName)
-	_, err := os.Stat(localPath)
-	if err == nil {
-		if g.dao != nil {
-			g.dao.Touch(ctx, filePathName, time.Now())
+// GetLoginURLWithState returns the login url carrying the caller supplied csrf state, offline access is always requested
+func (g *GDrive) GetLoginURLWithState(state string, opts ...oauth2.AuthCodeOption) string {
+	now := g.now()
+	g.mut.Lock()
+	// states of abandoned logins are dropped here, so the map stays bounded
+	for issued, expiry := range g.loginStates {
+		if !now.Before(expiry) {
+			delete(g.loginStates, issued)
 		}
-		return nil
 	}
-	files, err := g.driveService.Files.List().
-		Q(fmt.Sprintf("name ='%s' and '%s' in parents and trashed = false",
-			g.convertToGDrive(filePathName), g.parentFolderID)).
-		Do()
+	g.loginStates[state] = now.Add(loginStateTTL)
+	g.mut.Unlock()
+	return g.oauthConfig.AuthCodeURL(state, append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, opts...)...)
+}
+
+// ExchangeOauthCode exchanges the code without checking the state, use ExchangeOauthCodeWithState for the hosted login flow
+func (g *GDrive) ExchangeOauthCode(code string, opts ...option.ClientOption) (*oauth2.Token, error) {
+	return g.exchange(g.ctx, code, opts...)
+}
+
+// ExchangeOauthCodeWithState exchanges the code only when the state was issued by GetLoginURL or GetLoginURLWithState,
+// otherwise ErrStateMismatch is returned. Each state can be exchanged once, within 15 minutes of its login url.
+func (g *GDrive) ExchangeOauthCodeWithState(ctx context.Context, state, code string, opts ...option.ClientOption) (*oauth2.Token, error) {
+	g.mut.Lock()
+	expiry, issued := g.loginStates[state]
+	delete(g.loginStates, state)
+	g.mut.Unlock()
+	if !issued || !g.now().Before(expiry) {
+		return nil, ErrStateMismatch
+	}
+	return g.exchange(ctx, code, opts...)
+}
+
+func (g *GDrive) exchange(ctx context.Context, code string, opts ...option.ClientOption) (*oauth2.Token, error) {
+	token, err := g.oauthConfig.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	err = g.setToken(token, opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if len(files.Files) == 0 {
-		return errors.New("file not available on google drive")
+	return token, nil
+}
+
+// RefreshToken forces a new access token to be fetched, even if the current one has not expired yet.
+// The new token is passed to Config.OnTokenRefresh so it can be persisted.
+func (g *GDrive) RefreshToken(ctx context.Context) (*oauth2.Token, error) {
+	tokenSource := g.tokens()
+	if tokenSource == nil {
+		return nil, ErrNotAuthenticated
 	}
-	resp, err := g.driveService.Files.Get(files.Files[0].Id).Download()
+	current, err := tokenSource.Token()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	b, err := io.ReadAll(resp.Body)
+	// a token without access token is always invalid, so the token source will refresh it
+	token, err := g.oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: current.RefreshToken}).Token()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = g.storeFileToLocal(ctx, filePathName, b)
+	g.authMut.RLock()
+	opts := g.exchangeOpts
+	g.authMut.RUnlock()
+	err = g.setToken(token, opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if g.dao != nil {
-		g.dao.InsertOrUpdate(ctx, &FileInfo{FileID: files.Files[0].Id, LastAccess: time.Now(), Filepath: filePathName,
-			Size: int64(len(b)), MimeType: files.Files[0].MimeType})
+	if g.config.OnTokenRefresh != nil {
+		g.config.OnTokenRefresh(token)
 	}
-	return nil
+	return token, nil
 }
 
-func (g *GDrive) UploadAll(ctx context.Context) error {
-	chanLimit := make(chan struct{}, 10)
-	wg := &sync.WaitGroup{}
-	filepath.Walk(g.config.LocalFolderRoot, func(path string, info fs.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
-		wg.Add(1)
-		go func(wg *sync.WaitGroup, limiter chan struct{}) {
-			limiter <- struct{}{}
-			defer func() {
-				wg.Done()
-				<-limiter
-			}()
-			rel, _ := filepath.Rel(g.config.LocalFolderRoot, path)
-			f, err := os.Open(path)
-			if err != nil {
-				logrus.WithError(err).Error("unable to open file in upload all")
-				return
-			}
-			b, err := io.ReadAll(f)
-			if err != nil {
-				logrus.WithError(err).Error("unable to read byte of the file in upload all")
-			}
-			logrus.WithField("path", path).Debug("uploading from upload all")
-			reader := bytes.NewReader(b)
-			res, err := g.uploadToCloud(ctx, rel, reader, false)
-			if err != nil {
-				logrus.WithError(err).Error("unable to store to google drive in upload all")
-			}
-			if g.dao != nil {
-				g.dao.InsertOrUpdate(ctx, &FileInfo{FileID: res.Id, LastAccess: time.Now(), Filepath: rel, Size: int64(len(b)), MimeType: res.MimeType})
-			}
-		}(wg, chanLimit)
-		return nil
-	})
-	wg.Wait()
+// setToken swaps the client to the token, the options are passed to the drive service after those of New
+func (g *GDrive) setToken(token *oauth2.Token, opts ...option.ClientOption) error {
+	tokenSource := newRefreshNotifier(g.oauthConfig.TokenSource(g.ctx, token), token, g.config.OnTokenRefresh)
+	httpClient := g.limitClient(oauth2.NewClient(g.ctx, tokenSource))
+	serviceOpts := make([]option.ClientOption, 0, 1+len(g.clientOptions)+len(opts))
+	serviceOpts = append(serviceOpts, option.WithHTTPClient(httpClient))
+	serviceOpts = append(serviceOpts, g.clientOptions...)
+	serviceOpts = append(serviceOpts, opts...)
+	driveService, err := drive.NewService(g.ctx, serviceOpts...)
+	if err != nil {
+		return err
+	}
+	g.authMut.Lock()
+	defer g.authMut.Unlock()
+	g.tokenSource = tokenSource
+	g.httpClient = httpClient
+	g.driveService = driveService
+	g.exchangeOpts = opts
 	return nil
 }
 
-func (g *GDrive) uploadToCloud(ctx context.Context, filepathName string, reader io.Reader, replace bool) (*drive.File, error) {
-	driveFile := g.getFileInCloud(ctx, filepathName)
-	if driveFile != nil && !replace {
-		return driveFile, nil
+// service returns the google drive service of the current token, nil before login
+func (g *GDrive) service() *drive.Service {
+	g.authMut.RLock()
+	defer g.authMut.RUnlock()
+	return g.driveService
+}
+
+// client returns the authenticated http client of the current token
+func (g *GDrive) client() *http.Client {
+	g.authMut.RLock()
+	defer g.authMut.RUnlock()
+	return g.httpClient
+}
+
+func (g *GDrive) tokens() oauth2.TokenSource {
+	g.authMut.RLock()
+	defer g.authMut.RUnlock()
+	return g.tokenSource
+}
+
+// refreshNotifier passes every token refreshed by the underlying token source to Config.OnTokenRefresh
+type refreshNotifier struct {
+	base        oauth2.TokenSource
+	onRefresh   func(token *oauth2.Token)
+	mut         sync.Mutex
+	accessToken string
+}
+
+func newRefreshNotifier(base oauth2.TokenSource, initial *oauth2.Token, onRefresh func(token *oauth2.Token)) oauth2.TokenSource {
+	if onRefresh == nil {
+		return base
 	}
-	if driveFile == nil {
-		return g.driveService.Files.Create(
-			&drive.File{
-				Name:    g.convertToGDrive(filepathName),
-				Parents: []string{g.parentFolderID},
-			}).
-			Media(reader).
-			Do()
+	n := &refreshNotifier{base: base, onRefresh: onRefresh}
+	if initial != nil {
+		n.accessToken = initial.AccessToken
 	}
-	return g.driveService.Files.Update(driveFile.Id, driveFile).Media(reader).Do()
+	return n
 }
 
-func (g *GDrive) getFileInCloud(ctx context.Context, filepathName string) *drive.File {
-	remoteName := g.convertToGDrive(filepathName)
-	files, err := g.driveService.Files.List().
-		Q(fmt.Sprintf("name ='%s' and '%s' in parents and mimeType != 'application/vnd.google-apps.folder' and trashed = false",
-			remoteName, g.parentFolderID)).
-		Do()
+func (n *refreshNotifier) Token() (*oauth2.Token, error) {
+	token, err := n.base.Token()
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	if len(files.Files) > 0 {
-		return files.Files[0]
+	n.mut.Lock()
+	refreshed := token.AccessToken != n.accessToken
+	n.accessToken = token.AccessToken
+	n.mut.Unlock()
+	if refreshed {
+		n.onRefresh(token)
 	}
-	return nil
+	return token, nil
 }
 
-func (g *GDrive) storeFileToLocal(ctx context.Context, filePathName string, bytes []byte) error {
-	localPath := g.localFullPath(filePathName)
-	dir := filepath.Dir(localPath)
-	_, err := os.Stat(dir)
-	if err != nil && os.IsNotExist(err) {
-		err = os.MkdirAll(dir, os.ModePerm)
+func (g *GDrive) StoreFile(ctx context.Context, fileInsertInfo *FileInsertInfo) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	// every version checked or versioned store runs on its own
+	if fileInsertInfo.ExpectedVersion > 0 || (g.config.ConflictMode == ConflictVersion && !fileInsertInfo.Replace) {
+		storedPath, err := g.storeFile(ctx, fileInsertInfo)
 		if err != nil {
 			return err
 		}
+		fileInsertInfo.StoredPath = storedPath
+		return nil
 	}
-	err = os.WriteFile(localPath, bytes, 0666)
-	if err != nil {
-		return err
+	// identical concurrent stores share a single upload
+	sum := sha256.Sum256(fileInsertInfo.FileBytes)
+	key := fmt.Sprintf("%s\x00%x\x00%t\x00%s\x00%d", fileInsertInfo.Filepath, sum, fileInsertInfo.Replace,
+		fileInsertInfo.Description, fileInsertInfo.Priority)
+	for {
+		sharedCtx, leave := g.joinStore(key)
+		ch := g.storeGroup.DoChan(key, func() (interface{}, error) {
+			return g.storeFile(sharedCtx, fileInsertInfo)
+		})
+		select {
+		case res := <-ch:
+			leave()
+			// joined a store abandoned by all its callers, run it again
+			if errors.Is(res.Err, context.Canceled) && ctx.Err() == nil && g.ctx.Err() == nil {
+				continue
+			}
+			if res.Err != nil {
+				return res.Err
+			}
+			fileInsertInfo.StoredPath = res.Val.(string)
+			return nil
+		case <-ctx.Done():
+			leave()
+			return ctx.Err()
+		}
 	}
-	return nil
 }
 
-func (g *GDrive) localFileExist(filePathName string) bool {
-	localPath := g.localFullPath(filePathName)
-	_, err := os.Stat(localPath)
-	if err != nil && os.IsNotExist(err) {
-		return false
-	}
-	return true
+// sharedStore is the context of a store shared by identical concurrent callers
+type sharedStore struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	callers int
 }
 
-func (g *GDrive) localFullPath(pathName string) string {
-	return path.Join(g.config.LocalFolderRoot, pathName)
+// joinStore returns the context of the shared store of the key, it is only cancelled once every caller left.
+// A cancelled caller leaves without failing the others.
+func (g *GDrive) joinStore(key string) (context.Context, func()) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.storeCalls == nil {
+		g.storeCalls = map[string]*sharedStore{}
+	}
+	shared, ok := g.storeCalls[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(g.ctx)
+		shared = &sharedStore{ctx: ctx, cancel: cancel}
+		g.storeCalls[key] = shared
+	}
+	shared.callers++
+	return shared.ctx, func() {
+		g.mut.Lock()
+		defer g.mut.Unlock()
+		if shared.callers--; shared.callers == 0 {
+			shared.cancel()
+			delete(g.storeCalls, key)
+		}
+	}
 }
 
-func (g *GDrive) getFolderName(name string) string {
-	return fmt.Sprintf("gdrive-%s", name)
-}
+func (g *GDrive) storeFile(ctx context.Context, fileInsertInfo *FileInsertInfo) (string, error) {
+	if g.config.RejectEmpty && len(fileInsertInfo.FileBytes) == 0 {
+		return "", fmt.Errorf("%s: %w", fileInsertInfo.Filepath, ErrEmptyFile)
+	}
+	filePathName, driveFile, unlock, err := g.claimStorePath(ctx, fileInsertInfo.Filepath, fileInsertInfo.Replace,
+		fileInsertInfo.ExpectedVersion)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
 
-func (g *GDrive) convertToGDrive(path string) string {
-	return strings.ReplaceAll(path, "/", "#")
-}
+	// the same stored bytes go to google drive and the local folder
+	stored, err := g.encodeContent(fileInsertInfo.FileBytes)
+	if err != nil {
+		return "", err
+	}
 
-func (g *GDrive) shouldRemove() bool {
-	if g.dao != nil {
-		total, err := g.dao.TotalSize(g.ctx)
-		if err != nil {
-			logrus.WithError(err).Error("unable to get total size from dao")
-			return false
+	// store it to google drive, large files through a resumable session that survives a dropped connection
+	reader := bytes.NewReader(stored)
+	opts := uploadOptions{replace: fileInsertInfo.Replace, description: fileInsertInfo.Description,
+		expectedVersion: fileInsertInfo.ExpectedVersion, size: int64(len(stored)), priority: fileInsertInfo.Priority}
+	var res *drive.File
+	resumable := g.useResumable(int64(len(stored))) && opts.expectedVersion == 0
+	if resumable {
+		// the local file is written first, ResumePendingUploads continues an interrupted session from it
+		err = g.storeFileToLocal(ctx, filePathName, stored)
+		if err == nil {
+			res, err = g.uploadResumable(ctx, filePathName, reader, int64(len(stored)), opts)
 		}
-		if total > g.config.TotalMaxSize {
-			logrus.WithField("total", total).WithField("maxSize", g.config.TotalMaxSize).Debug("total size exceeded")
-			list, err := g.dao.QueryOldest(g.ctx, 10)
-			if err != nil {
-				logrus.WithError(err).Error("unable to query older from dao")
-				return false
-			}
-			diff := total - g.config.TotalMaxSize
-			var totalToRemove int64
-			toRemove := []FileInfo{}
-			for i := range list {
-				totalToRemove += list[i].Size
-				toRemove = append(toRemove, list[i])
-				if totalToRemove > diff {
-					break
-				}
-			}
-			for _, rem := range toRemove {
-				err := g.dao.Delete(g.ctx, rem.Filepath)
-				if err != nil {
-					logrus.WithError(err).Error("unable to remove from dao")
-					return false
-				}
-				err = os.Remove(g.localFullPath(rem.Filepath))
-				if err != nil {
-					logrus.WithError(err).Error("unable to remove file")
-					return false
+		if err != nil && !g.hasSession(filePathName) {
+			g.removeLocal(ctx, FileInfo{Filepath: filePathName, ContentHash: g.contentHash(stored)})
+		}
+	} else {
+		res, err = g.uploadToCloud(ctx, filePathName, reader, opts)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if g.config.VerifyAfterUpload {
+		err = g.verifyUpload(ctx, res.Id, stored)
+		if err != nil {
+			// a newly created file is removed again, a replaced file keeps its new revision
+			if driveFile == nil {
+				err := g.withRetry(ctx, func() error {
+					return g.filesDelete(res.Id).Context(ctx).Do()
+				})
+				if err == nil {
+					g.forgetRemote(filePathName)
+					g.audit(ctx, AuditDelete, filePathName, res.Id, int64(len(fileInsertInfo.FileBytes)))
 				}
 			}
-			if diff > totalToRemove {
-				return true
-			}
+			return "", err
 		}
 	}
-	return false
+
+	// store it to local folder
+	if !resumable {
+		err = g.storeFileToLocal(ctx, filePathName, stored)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if g.dao != nil {
+		g.dao.InsertOrUpdate(ctx, &FileInfo{FileID: res.Id, LastAccess: g.now(), Filepath: filePathName,
+			Size: int64(len(fileInsertInfo.FileBytes)), StoredSize: storedSize(int64(len(fileInsertInfo.FileBytes)), int64(len(stored))),
+			MimeType: res.MimeType, Description: res.Description, Version: res.Version, Priority: fileInsertInfo.Priority,
+			ContentHash: g.contentHash(stored), Md5: res.Md5Checksum})
+	}
+	g.recordAccess(AccessStore, filePathName, int64(len(fileInsertInfo.FileBytes)))
+
+	return filePathName, nil
 }
 
-// this only for testing
-func (g *GDrive) deleteRootFolder(ctx context.Context) error {
-	return g.driveService.Files.Delete(g.parentFolderID).Do()
+// claimStorePath resolves and locks the cached path of a store: the date partition of Config.DatePartition and the
+// free version of ConflictVersion. Without replace an existing path fails with ErrFileExist. The returned google
+// drive file is the one the store replaces, nil for a new file. unlock must be called once the store is done.
+func (g *GDrive) claimStorePath(ctx context.Context, requested string, replace bool, expectedVersion int64) (string, *drive.File, func(), error) {
+	filePathName := g.partitionPath(requested, g.now())
+	unlockPath := g.pathLocks.lock(filePathName)
+	unlock := unlockPath
+	if g.config.ConflictMode == ConflictVersion && !replace {
+		versionPath, err := g.nextFreePath(ctx, filePathName)
+		if err != nil {
+			unlock()
+			return "", nil, nil, err
+		}
+		if versionPath != filePathName {
+			// the versioned path is taken while the base path is still held, so two stores never pick the same version
+			unlockVersion := g.pathLocks.lock(versionPath)
+			unlock = func() {
+				unlockVersion()
+				unlockPath()
+			}
+			filePathName = versionPath
+		}
+	}
+
+	// check if file exist in local
+	_, err := os.Stat(g.localFullPath(filePathName))
+	if err == nil && !replace && !g.isPlaceholder(ctx, filePathName) {
+		unlock()
+		return "", nil, nil, ErrFileExist
+	}
+	if err != nil && !os.IsNotExist(err) {
+		unlock()
+		return "", nil, nil, err
+	}
+
+	var driveFile *drive.File
+	if expectedVersion > 0 {
+		driveFile = g.queryRemote(ctx, filePathName)
+	} else {
+		driveFile = g.getFileInCloud(ctx, filePathName)
+	}
+	if driveFile != nil && !replace {
+		unlock()
+		return "", nil, nil, ErrFileExist
+	}
+	return filePathName, driveFile, unlock, nil
+}
+
+// nextFreePath returns the path itself when it is free, otherwise the first suffixed version of it
+// that exists neither locally nor on google drive
+func (g *GDrive) nextFreePath(ctx context.Context, filePathName string) (string, error) {
+	format := g.config.VersionSuffixFormat
+	if format == "" {
+		format = defaultVersionSuffixFormat
+	}
+	ext := path.Ext(filePathName)
+	base := strings.TrimSuffix(filePathName, ext)
+	candidate := filePathName
+	for version := 1; version <= maxVersionSuffix; version++ {
+		localExist := g.localFileExist(candidate) && !g.isPlaceholder(ctx, candidate)
+		if !localExist && g.getFileInCloud(ctx, candidate) == nil {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf(format, base, version, ext)
+	}
+	return "", fmt.Errorf("%s: no free version: %w", filePathName, ErrFileExist)
+}
+
+func (g *GDrive) TouchFile(ctx context.Context, filePathName string) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	unlock := g.pathLocks.lock(filePathName)
+	stat, err := os.Stat(g.localFullPath(filePathName))
+	if err == nil {
+		if g.dao != nil {
+			g.dao.Touch(ctx, filePathName, g.now())
+		}
+		unlock()
+		g.metrics().IncHit()
+		g.recordAccess(AccessTouch, filePathName, stat.Size())
+		return nil
+	}
+	unlock()
+	g.metrics().IncMiss()
+
+	// concurrent touches of a missing file share one download and its error
+	size, err, _ := g.touchGroup.Do(filePathName, func() (interface{}, error) {
+		return g.touchDownload(ctx, filePathName)
+	})
+	if err != nil || size.(int64) < 0 {
+		return err
+	}
+	g.recordAccess(AccessTouch, filePathName, size.(int64))
+	return nil
+}
+
+// touchDownload downloads the missing file of TouchFile and returns its size, -1 when it is not on google drive
+// and Config.TouchMissing handled it
+func (g *GDrive) touchDownload(ctx context.Context, filePathName string) (int64, error) {
+	unlock := g.pathLocks.lock(filePathName)
+	defer unlock()
+	// the file may have been stored since TouchFile looked
+	if stat, err := os.Stat(g.localFullPath(filePathName)); err == nil {
+		return stat.Size(), nil
+	}
+	b, err := g.downloadToLocal(ctx, filePathName)
+	if errors.Is(err, ErrNotFound) {
+		return -1, g.touchMissing(ctx, filePathName)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
+
+// ReadFile returns the cached bytes, downloading the file from google drive on a cache miss.
+// A file that is neither cached nor on google drive returns an error wrapping ErrNotFound.
+func (g *GDrive) ReadFile(ctx context.Context, filePathName string) ([]byte, error) {
+	if g.service() == nil {
+		return nil, ErrNotAuthenticated
+	}
+	return g.readFile(ctx, filePathName)
+}
+
+// readFile returns the cached bytes, downloading the file from google drive on a cache miss
+func (g *GDrive) readFile(ctx context.Context, filePathName string) ([]byte, error) {
+	unlock := g.pathLocks.lock(filePathName)
+	defer unlock()
+	b, err := os.ReadFile(g.localFullPath(filePathName))
+	if err == nil {
+		b, err = g.decodeContent(b)
+		if err != nil {
+			return nil, err
+		}
+		if g.dao != nil {
+			g.dao.Touch(ctx, filePathName, g.now())
+		}
+		g.recordAccess(AccessGet, filePathName, int64(len(b)))
+		return b, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	b, err = g.downloadToLocal(ctx, filePathName)
+	if err != nil {
+		return nil, err
+	}
+	g.recordAccess(AccessGet, filePathName, int64(len(b)))
+	return b, nil
+}
+
+// downloadToLocal downloads the file from google drive into the local folder and records it in the dao
+func (g *GDrive) downloadToLocal(ctx context.Context, filePathName string) ([]byte, error) {
+	// a file cached before is downloaded by the id recorded in the dao, saving the lookup by name
+	if driveFile := g.daoRemote(ctx, filePathName); driveFile != nil {
+		b, err := g.downloadFile(ctx, filePathName, driveFile)
+		if err == nil || ctx.Err() != nil {
+			return b, err
+		}
+		// the record may be stale, the file may have been replaced or removed elsewhere
+		g.logger().Debugf("unable to download %s by its recorded id, looking it up: %v", filePathName, err)
+	}
+	driveFile, err := g.findRemote(ctx, filePathName)
+	if err != nil {
+		return nil, err
+	}
+	return g.downloadFile(ctx, filePathName, driveFile)
+}
+
+// daoRemote returns the google drive file recorded in the dao, nil when the dao does not know its id
+func (g *GDrive) daoRemote(ctx context.Context, filePathName string) *drive.File {
+	if g.dao == nil {
+		return nil
+	}
+	fileInfo, err := g.dao.Get(ctx, filePathName)
+	if err != nil || fileInfo.FileID == "" {
+		return nil
+	}
+	driveFile := &drive.File{Id: fileInfo.FileID, MimeType: fileInfo.MimeType, Size: fileInfo.DiskSize(),
+		Md5Checksum: fileInfo.Md5, Description: fileInfo.Description, Version: fileInfo.Version}
+	if fileInfo.SourceMimeType != "" {
+		// exported files are downloaded through the export of their native type
+		driveFile.MimeType = fileInfo.SourceMimeType
+	}
+	return driveFile
+}
+
+// findRemote returns the google drive file of the path, or an error wrapping ErrNotFound
+func (g *GDrive) findRemote(ctx context.Context, filePathName string) (*drive.File, error) {
+	folderID, name, err := g.remoteLocation(ctx, filePathName, false)
+	if err != nil {
+		return nil, err
+	}
+	if folderID == "" {
+		return nil, fmt.Errorf("%s: %w", filePathName, ErrNotFound)
+	}
+	var files *drive.FileList
+	find := func(name string) error {
+		return g.withRetry(ctx, func() (err error) {
+			files, err = g.filesList().
+				Q(fmt.Sprintf("name ='%s' and '%s' in parents and trashed = false",
+					escapeDriveQuery(name), escapeDriveQuery(folderID))).
+				Fields(listFields...).
+				Context(ctx).
+				Do()
+			return err
+		})
+	}
+	err = find(name)
+	if err == nil && len(files.Files) == 0 {
+		if legacy := g.legacyRemoteName(filePathName); legacy != "" {
+			err = find(legacy)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(files.Files) == 0 {
+		return nil, fmt.Errorf("%s: %w", filePathName, ErrNotFound)
+	}
+	return files.Files[0], nil
+}
+
+// downloadFile downloads the given google drive file into the local folder and records it in the dao
+func (g *GDrive) downloadFile(ctx context.Context, filePathName string, driveFile *drive.File) ([]byte, error) {
+	g.startDownload(filePathName)
+	defer g.finishDownload(filePathName)
+
+	var b, stored []byte
+	var err error
+	exportMimeType := g.config.ExportMap[driveFile.MimeType]
+	if exportMimeType != "" {
+		// google exports the file bytes, they are encoded for the local folder like a stored file
+		b, err = g.downloadExport(ctx, driveFile, exportMimeType)
+		if err == nil {
+			stored, err = g.encodeContent(b)
+		}
+	} else {
+		if parts := g.downloadPartCount(driveFile.Size); parts > 1 {
+			stored, err = g.downloadInParts(ctx, driveFile, parts)
+		} else {
+			stored, err = g.downloadWhole(ctx, filePathName, driveFile)
+		}
+		// content that can not be decoded is never cached
+		if err == nil {
+			b, err = g.decodeContent(stored)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = g.storeFileToLocal(ctx, filePathName, stored)
+	if err != nil {
+		return nil, err
+	}
+	g.recordDownload(ctx, filePathName, driveFile, int64(len(b)), storedSize(int64(len(b)), int64(len(stored))), g.contentHash(stored))
+	return b, nil
+}
+
+// recordDownload inserts the dao row of a file downloaded into the cache
+func (g *GDrive) recordDownload(ctx context.Context, filePathName string, driveFile *drive.File, size, storedSize int64, contentHash string) {
+	if g.dao == nil {
+		return
+	}
+	fileInfo := &FileInfo{FileID: driveFile.Id, LastAccess: g.now(), Filepath: filePathName,
+		Size: size, StoredSize: storedSize, MimeType: driveFile.MimeType, ContentHash: contentHash}
+	if exportMimeType := g.config.ExportMap[driveFile.MimeType]; exportMimeType != "" {
+		fileInfo.MimeType = exportMimeType
+		fileInfo.SourceMimeType = driveFile.MimeType
+	} else {
+		fileInfo.Md5 = driveFile.Md5Checksum
+	}
+	g.dao.InsertOrUpdate(ctx, fileInfo)
+}
+
+func (g *GDrive) startDownload(filePathName string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.downloading[filePathName]++
+}
+
+func (g *GDrive) finishDownload(filePathName string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.downloading[filePathName]--; g.downloading[filePathName] <= 0 {
+		delete(g.downloading, filePathName)
+	}
+}
+
+func (g *GDrive) downloadWhole(ctx context.Context, filePathName string, driveFile *drive.File) ([]byte, error) {
+	var resp *http.Response
+	err := g.withRetry(ctx, func() (err error) {
+		resp, err = g.filesGet(driveFile.Id).Context(ctx).Download()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(g.withProgress(filePathName, resp.Body, driveFile.Size))
+	if err != nil {
+		return nil, err
+	}
+	err = verifyMd5(driveFile, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// verifyMd5 checks the downloaded content against the md5 checksum of google drive so a truncated or corrupted
+// download is never cached, files without a checksum are accepted
+func verifyMd5(driveFile *drive.File, b []byte) error {
+	if driveFile.Md5Checksum == "" {
+		return nil
+	}
+	sum := md5.Sum(b)
+	if hex.EncodeToString(sum[:]) != driveFile.Md5Checksum {
+		return fmt.Errorf("%s: %w", driveFile.Id, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// downloadExport exports a google native file, like a document, in the given mime type
+func (g *GDrive) downloadExport(ctx context.Context, driveFile *drive.File, mimeType string) ([]byte, error) {
+	var resp *http.Response
+	err := g.withRetry(ctx, func() (err error) {
+		resp, err = g.service().Files.Export(driveFile.Id, mimeType).Context(ctx).Download()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// StreamFiles sends every requested file to the returned channel as soon as it is available.
+// Cache misses are downloaded concurrently up to Config.DownloadConcurrency, so results arrive out of order.
+// The channel is closed once all files are sent.
+func (g *GDrive) StreamFiles(ctx context.Context, paths []string) (<-chan FileResult, error) {
+	if g.service() == nil {
+		return nil, ErrNotAuthenticated
+	}
+	results := make(chan FileResult, len(paths))
+	chanLimit := make(chan struct{}, g.downloadConcurrency())
+	wg := &sync.WaitGroup{}
+	for _, p := range paths {
+		wg.Add(1)
+		go func(filePathName string) {
+			defer wg.Done()
+			select {
+			case chanLimit <- struct{}{}:
+			case <-ctx.Done():
+				results <- FileResult{Filepath: filePathName, Err: ctx.Err()}
+				return
+			}
+			defer func() { <-chanLimit }()
+			b, err := g.readFile(ctx, filePathName)
+			results <- FileResult{Filepath: filePathName, Bytes: b, Err: err}
+		}(p)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results, nil
+}
+
+// CacheFolder downloads every remote file whose path starts with prefix into the local cache.
+// Files already cached are skipped, downloads run concurrently up to Config.DownloadConcurrency
+// and the returned error joins the failed files.
+func (g *GDrive) CacheFolder(ctx context.Context, prefix string) error {
+	return g.cacheRemote(ctx, prefix, false)
+}
+
+// DownloadAll downloads every file of google drive missing in the local folder, to warm the cache of a new machine.
+// Downloads run concurrently up to Config.DownloadConcurrency and stop once the next file would exceed
+// Config.TotalMaxSize. The returned error joins the failed files.
+func (g *GDrive) DownloadAll(ctx context.Context) error {
+	return g.cacheRemote(ctx, "", true)
+}
+
+// cacheRemote downloads the remote files of the prefix missing locally, within TotalMaxSize when withinBudget is set
+func (g *GDrive) cacheRemote(ctx context.Context, prefix string, withinBudget bool) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	remoteFiles, err := g.listRemote(ctx)
+	if err != nil {
+		return err
+	}
+	maxSize := g.totalMaxSize()
+	var used int64
+	if withinBudget && maxSize > 0 && g.dao != nil {
+		used, err = g.dao.TotalSize(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	chanLimit := make(chan struct{}, g.downloadConcurrency())
+	wg := &sync.WaitGroup{}
+	errMut := sync.Mutex{}
+	errs := []error{}
+	for _, entry := range remoteFiles {
+		filePathName, driveFile := entry.Path, entry.File
+		if !strings.HasPrefix(filePathName, prefix) || g.localFileExist(filePathName) {
+			continue
+		}
+		if withinBudget && maxSize > 0 {
+			if used+driveFile.Size > maxSize {
+				g.logger().Warnf("local cache is full, stopped downloading at %s", filePathName)
+				break
+			}
+			used += driveFile.Size
+		}
+		wg.Add(1)
+		go func(filePathName string, driveFile *drive.File) {
+			defer wg.Done()
+			select {
+			case chanLimit <- struct{}{}:
+			case <-ctx.Done():
+				errMut.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", filePathName, ctx.Err()))
+				errMut.Unlock()
+				return
+			}
+			defer func() { <-chanLimit }()
+			unlock := g.pathLocks.lock(filePathName)
+			defer unlock()
+			// the file may have been stored or read since the listing
+			if g.localFileExist(filePathName) {
+				return
+			}
+			_, err := g.downloadFile(ctx, filePathName, driveFile)
+			if err != nil {
+				g.logger().Errorf("unable to cache file %s: %v", filePathName, err)
+				errMut.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", filePathName, err))
+				errMut.Unlock()
+				return
+			}
+			g.logger().Debugf("file %s cached", filePathName)
+		}(filePathName, driveFile)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// ListFiles returns one page of the files stored on google drive and the token of the next page,
+// which is empty on the last page. Pass an empty token for the first page. A page size of zero or less uses
+// the default of google drive, larger than 1000 is reduced to 1000.
+// With Config.UseNativeFolders only the files directly inside the parent folder are listed.
+func (g *GDrive) ListFiles(ctx context.Context, pageToken string, pageSize int) ([]FileInfo, string, error) {
+	if g.service() == nil {
+		return nil, "", ErrNotAuthenticated
+	}
+	if pageSize > maxListPageSize {
+		pageSize = maxListPageSize
+	}
+	var files *drive.FileList
+	err := g.withRetry(ctx, func() (err error) {
+		call := g.filesList().
+			Q(fmt.Sprintf("'%s' in parents and mimeType != 'application/vnd.google-apps.folder' and trashed = false", escapeDriveQuery(g.parentFolderID))).
+			Fields(listFields...).
+			PageToken(pageToken)
+		if pageSize > 0 {
+			call = call.PageSize(int64(pageSize))
+		}
+		files, err = call.Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	retVal := make([]FileInfo, 0, len(files.Files))
+	for _, f := range files.Files {
+		retVal = append(retVal, FileInfo{FileID: f.Id, Filepath: g.convertFromGDrive(f.Name), Size: f.Size, MimeType: f.MimeType,
+			Description: f.Description, Version: f.Version})
+	}
+	return retVal, files.NextPageToken, nil
+}
+
+// listRemote returns every file stored in the parent folder, including the subfolders with Config.UseNativeFolders
+func (g *GDrive) listRemote(ctx context.Context) ([]remoteEntry, error) {
+	retVal := []remoteEntry{}
+	folders := []remoteEntry{{Path: "", File: &drive.File{Id: g.parentFolderID}}}
+	for len(folders) > 0 {
+		folder := folders[0]
+		folders = folders[1:]
+		query := fmt.Sprintf("'%s' in parents and trashed = false", escapeDriveQuery(folder.File.Id))
+		if !g.config.UseNativeFolders {
+			query += " and mimeType != 'application/vnd.google-apps.folder'"
+		}
+		pageToken := ""
+		for {
+			var files *drive.FileList
+			err := g.withRetry(ctx, func() (err error) {
+				files, err = g.filesList().
+					Q(query).
+					Fields(listFields...).
+					PageToken(pageToken).
+					Context(ctx).
+					Do()
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files.Files {
+				if !g.config.UseNativeFolders {
+					retVal = append(retVal, remoteEntry{Path: g.convertFromGDrive(f.Name), File: f})
+					continue
+				}
+				entry := remoteEntry{Path: path.Join(folder.Path, f.Name), File: f}
+				if f.MimeType == "application/vnd.google-apps.folder" {
+					folders = append(folders, entry)
+				} else {
+					retVal = append(retVal, entry)
+				}
+			}
+			if files.NextPageToken == "" {
+				break
+			}
+			pageToken = files.NextPageToken
+		}
+	}
+	return retVal, nil
+}
+
+func (g *GDrive) touchMissing(ctx context.Context, filePathName string) error {
+	switch g.config.TouchMissing {
+	case TouchMissingIgnore:
+		return nil
+	case TouchMissingPlaceholder:
+		err := g.storeFileToLocal(ctx, filePathName, []byte{})
+		if err != nil {
+			return err
+		}
+		g.setPlaceholder(filePathName, true)
+		if g.dao != nil {
+			g.dao.InsertOrUpdate(ctx, &FileInfo{LastAccess: g.now(), Filepath: filePathName,
+				ContentHash: g.contentHash([]byte{}), Placeholder: true})
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: %w", filePathName, ErrNotFound)
+}
+
+// isPlaceholder reports whether the local file is a placeholder of TouchMissingPlaceholder. A store overwrites a
+// placeholder without Replace and UploadAll never uploads it.
+func (g *GDrive) isPlaceholder(ctx context.Context, filePathName string) bool {
+	g.mut.Lock()
+	_, ok := g.placeholders[filePathName]
+	g.mut.Unlock()
+	if ok || g.dao == nil {
+		return ok
+	}
+	// placeholders created before a restart are only known by the dao
+	fileInfo, err := g.dao.Get(ctx, filePathName)
+	return err == nil && fileInfo.Placeholder
+}
+
+func (g *GDrive) setPlaceholder(filePathName string, placeholder bool) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if placeholder {
+		g.placeholders[filePathName] = struct{}{}
+	} else {
+		delete(g.placeholders, filePathName)
+	}
+}
+
+// UploadAll uploads every local file missing on google drive, up to Config.UploadConcurrency at a time.
+// A failed file does not stop the others, the returned error joins every failed file.
+func (g *GDrive) UploadAll(ctx context.Context) error {
+	_, err := g.UploadAllWithResult(ctx)
+	return err
+}
+
+// UploadAllResult lists the files sent by UploadAllWithResult, the ones skipped because google drive already
+// had an identical copy or they are not uploadable, and the ones differing from an existing google drive file
+type UploadAllResult struct {
+	Uploaded  []string
+	Skipped   []string // identical on google drive, placeholders and files exported through Config.ExportMap
+	Conflicts []string // google drive has different content, it is never replaced by the local copy
+}
+
+// uploadOutcome is what uploadLocal did with a local file
+type uploadOutcome int
+
+const (
+	uploadDone uploadOutcome = iota
+	uploadSkipped
+	uploadConflict
+)
+
+// UploadAllWithResult is UploadAll reporting which files were uploaded and which were skipped
+func (g *GDrive) UploadAllWithResult(ctx context.Context) (UploadAllResult, error) {
+	if g.service() == nil {
+		return UploadAllResult{}, ErrNotAuthenticated
+	}
+	result := UploadAllResult{Uploaded: []string{}, Skipped: []string{}, Conflicts: []string{}}
+	chanLimit := make(chan struct{}, g.uploadConcurrency())
+	wg := &sync.WaitGroup{}
+	errMut := sync.Mutex{}
+	errs := []error{}
+	walkErr := g.walkLocal(func(rel string, info fs.FileInfo) error {
+		wg.Add(1)
+		go func() {
+			chanLimit <- struct{}{}
+			defer func() {
+				wg.Done()
+				<-chanLimit
+			}()
+			outcome, err := g.uploadLocal(ctx, rel, info.Size())
+			errMut.Lock()
+			defer errMut.Unlock()
+			switch {
+			case err != nil:
+				g.logger().Errorf("unable to store %s to google drive in upload all: %v", rel, err)
+				errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+			case outcome == uploadSkipped:
+				result.Skipped = append(result.Skipped, rel)
+			case outcome == uploadConflict:
+				result.Conflicts = append(result.Conflicts, rel)
+			default:
+				result.Uploaded = append(result.Uploaded, rel)
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	sort.Strings(result.Uploaded)
+	sort.Strings(result.Skipped)
+	sort.Strings(result.Conflicts)
+	return result, errors.Join(append(errs, walkErr)...)
+}
+
+// uploadLocal streams the local file to google drive and records it in the dao.
+// The upload is skipped when google drive already has a file of the same size and md5 checksum, a different
+// google drive file is a conflict and is left alone. Placeholders and exported files are never uploaded.
+func (g *GDrive) uploadLocal(ctx context.Context, rel string, size int64) (uploadOutcome, error) {
+	var stored *FileInfo
+	if g.dao != nil {
+		var err error
+		stored, err = g.dao.Get(ctx, rel)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return uploadDone, err
+		}
+	}
+	if stored != nil && (stored.Placeholder || stored.SourceMimeType != "") || g.dao == nil && g.isPlaceholder(ctx, rel) {
+		// the content would replace the google drive file it stands for
+		g.logger().Debugf("skipping placeholder or exported file %s in upload all", rel)
+		return uploadSkipped, nil
+	}
+	f, err := os.Open(g.localFullPath(rel))
+	if err != nil {
+		return uploadDone, err
+	}
+	defer f.Close()
+	res, identical, err := g.identicalRemote(ctx, rel, f, size)
+	if err != nil {
+		return uploadDone, err
+	}
+	outcome := uploadDone
+	opts := uploadOptions{size: size}
+	if identical {
+		g.logger().Debugf("skipping identical file %s in upload all", rel)
+		outcome = uploadSkipped
+	} else if res != nil {
+		// the local copy may be stale, google drive keeps its content
+		g.logger().Warnf("%s differs from google drive, not uploaded in upload all", rel)
+		return uploadConflict, nil
+	} else if g.useResumable(size) {
+		g.logger().Debugf("uploading %s resumable from upload all", rel)
+		res, err = g.uploadResumable(ctx, rel, f, size, opts)
+	} else {
+		g.logger().Debugf("uploading %s from upload all", rel)
+		res, err = g.uploadToCloud(ctx, rel, f, opts)
+	}
+	if err != nil {
+		return uploadDone, err
+	}
+	if g.dao != nil {
+		fileInfo, err := g.uploadedFileInfo(rel, res, size)
+		if err != nil {
+			return uploadDone, err
+		}
+		if stored != nil {
+			// google drive knows nothing of these, the existing row does
+			fileInfo.Priority = stored.Priority
+			fileInfo.SourceMimeType = stored.SourceMimeType
+		}
+		g.dao.InsertOrUpdate(ctx, fileInfo)
+	}
+	return outcome, nil
+}
+
+// identicalRemote returns the google drive file of the path, identical is true when it has the size and
+// md5 checksum of the local file. The local file is only hashed when the sizes match.
+func (g *GDrive) identicalRemote(ctx context.Context, rel string, f *os.File, size int64) (driveFile *drive.File, identical bool, err error) {
+	driveFile = g.getFileInCloud(ctx, rel)
+	if driveFile == nil || driveFile.Size != size {
+		return driveFile, false, nil
+	}
+	if driveFile.Md5Checksum != "" {
+		h := md5.New()
+		_, err := io.Copy(h, f)
+		if err != nil {
+			return nil, false, err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, false, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != driveFile.Md5Checksum {
+			return driveFile, false, nil
+		}
+	}
+	return driveFile, true, nil
+}
+
+// Exists reports whether the file is cached locally and whether it is stored on google drive, without downloading it
+func (g *GDrive) Exists(ctx context.Context, filePathName string) (local bool, remote bool, err error) {
+	if g.service() == nil {
+		return false, false, ErrNotAuthenticated
+	}
+	local = g.localFileExist(filePathName)
+	if driveFile, known := g.indexedRemote(filePathName); known {
+		return local, driveFile != nil, nil
+	}
+	folderID, name, err := g.remoteLocation(ctx, filePathName, false)
+	if err != nil || folderID == "" {
+		return local, false, err
+	}
+	var files *drive.FileList
+	err = g.withRetry(ctx, func() (err error) {
+		files, err = g.filesList().
+			Q(fmt.Sprintf("name ='%s' and '%s' in parents and mimeType != 'application/vnd.google-apps.folder' and trashed = false",
+				escapeDriveQuery(name), escapeDriveQuery(folderID))).
+			Fields("files(id)").
+			PageSize(1).
+			Context(ctx).
+			Do()
+		return err
+	})
+	if err != nil {
+		return local, false, err
+	}
+	return local, len(files.Files) > 0, nil
+}
+
+// DeleteFile removes the file from google drive, the local folder and the dao.
+// Every step is attempted, the returned error joins the failed ones. A file found nowhere returns ErrNotFound.
+func (g *GDrive) DeleteFile(ctx context.Context, filePathName string) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	unlock := g.pathLocks.lock(filePathName)
+	defer unlock()
+	found := false
+	errs := []error{}
+	fileInfo := FileInfo{Filepath: filePathName}
+	if g.config.ContentAddressedLocal && g.dao != nil {
+		// the content hash is needed to release the shared blob
+		stored, err := g.dao.Get(ctx, filePathName)
+		if err == nil {
+			fileInfo = *stored
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+
+	if driveFile := g.getFileInCloud(ctx, filePathName); driveFile != nil {
+		found = true
+		fileInfo.FileID = driveFile.Id
+		fileInfo.Size = driveFile.Size
+		err := g.withRetry(ctx, func() error {
+			return g.filesDelete(driveFile.Id).Context(ctx).Do()
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+		g.forgetRemote(filePathName)
+	}
+	if g.dao != nil {
+		err := g.dao.Delete(ctx, filePathName)
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	err := g.removeLocal(ctx, fileInfo)
+	if err == nil {
+		found = true
+	} else if !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %w", filePathName, errors.Join(errs...))
+	}
+	if !found {
+		return fmt.Errorf("%s: %w", filePathName, ErrNotFound)
+	}
+	g.audit(ctx, AuditDelete, filePathName, fileInfo.FileID, fileInfo.Size)
+	return nil
+}
+
+// DeleteDir deletes every file under the folder prefix from google drive, the local folder and the dao.
+// With Config.UseNativeFolders the google drive subfolder is removed as well. The returned error joins the failed files.
+func (g *GDrive) DeleteDir(ctx context.Context, prefix string) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	prefix, err := g.cleanDir(prefix)
+	if err != nil {
+		return err
+	}
+	dir := prefix + "/"
+
+	// every path under the folder known to google drive, the local folder or the dao
+	paths := map[string]struct{}{}
+	remoteFiles, err := g.listRemote(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range remoteFiles {
+		if strings.HasPrefix(entry.Path, dir) {
+			paths[entry.Path] = struct{}{}
+		}
+	}
+	err = g.walkLocal(func(rel string, info fs.FileInfo) error {
+		if strings.HasPrefix(rel, dir) {
+			paths[rel] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if g.dao != nil {
+		files, err := g.dao.QueryByPrefix(ctx, dir)
+		if err != nil {
+			return err
+		}
+		for i := range files {
+			paths[files[i].Filepath] = struct{}{}
+		}
+	}
+
+	errs := []error{}
+	for p := range paths {
+		err := g.DeleteFile(ctx, p)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	if g.config.UseNativeFolders && len(errs) == 0 {
+		err = g.deleteRemoteFolder(ctx, prefix)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		err = os.RemoveAll(g.localFullPath(prefix))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteRemoteFolder removes the google drive subfolder of the relative dir and forgets it and its subfolders
+func (g *GDrive) deleteRemoteFolder(ctx context.Context, relDir string) error {
+	g.folderMut.Lock()
+	defer g.folderMut.Unlock()
+	folderID, err := g.resolveRemoteFolderLocked(ctx, relDir, false)
+	if err != nil || folderID == "" {
+		return err
+	}
+	err = g.withRetry(ctx, func() error {
+		return g.filesDelete(folderID).Context(ctx).Do()
+	})
+	if err != nil {
+		return err
+	}
+	for dir := range g.remoteFolders {
+		if dir == relDir || strings.HasPrefix(dir, relDir+"/") {
+			delete(g.remoteFolders, dir)
+		}
+	}
+	return nil
+}
+
+// GetFileInfo returns the dao metadata of the cached file without calling google drive.
+// A path missing from the dao returns an error wrapping ErrNotFound.
+func (g *GDrive) GetFileInfo(ctx context.Context, filePathName string) (*FileInfo, error) {
+	if g.dao == nil {
+		return nil, fmt.Errorf("%s: %w", filePathName, ErrNotFound)
+	}
+	fileInfo, err := g.dao.Get(ctx, filePathName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePathName, err)
+	}
+	return fileInfo, nil
+}
+
+// RetainOnly pins the given paths and evicts every other local file from the cache.
+// Retained paths are never touched, so concurrent stores of them are preserved. A file being read or stored
+// while it is evicted is skipped like in the regular eviction.
+func (g *GDrive) RetainOnly(ctx context.Context, paths []string) error {
+	return g.retainOnly(ctx, paths, false)
+}
+
+// RetainOnlyEvictRemote works like RetainOnly and also deletes the evicted files from google drive.
+func (g *GDrive) RetainOnlyEvictRemote(ctx context.Context, paths []string) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	return g.retainOnly(ctx, paths, true)
+}
+
+func (g *GDrive) retainOnly(ctx context.Context, paths []string, remote bool) error {
+	retain := make(map[string]struct{}, len(paths))
+	g.mut.Lock()
+	for _, p := range paths {
+		retain[p] = struct{}{}
+		g.pinned[p] = struct{}{}
+	}
+	g.mut.Unlock()
+
+	toRemove := []FileInfo{}
+	err := g.walkLocal(func(rel string, info fs.FileInfo) error {
+		if _, ok := retain[rel]; !ok {
+			toRemove = append(toRemove, FileInfo{Filepath: rel, Size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rem := range toRemove {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := g.retainEvict(ctx, rem, remote)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rem.Filepath, err)
+		}
+	}
+	return nil
+}
+
+// retainEvict evicts one file not retained by RetainOnly, holding the lock of its path
+func (g *GDrive) retainEvict(ctx context.Context, rem FileInfo, remote bool) error {
+	unlock, inUse := g.claimForEviction(rem.Filepath)
+	if inUse {
+		g.logger().Debugf("skipping %s in use in retain only", rem.Filepath)
+		return nil
+	}
+	defer unlock()
+	if !g.localFileExist(rem.Filepath) {
+		// removed since the walk
+		return nil
+	}
+	if remote {
+		if driveFile := g.getFileInCloud(ctx, rem.Filepath); driveFile != nil {
+			rem.FileID = driveFile.Id
+			err := g.withRetry(ctx, func() error {
+				return g.filesDelete(driveFile.Id).Context(ctx).Do()
+			})
+			if err != nil {
+				return err
+			}
+			g.forgetRemote(rem.Filepath)
+		}
+	}
+	if g.dao != nil {
+		// the dao row has the content hash, needed to release a shared blob
+		stored, err := g.dao.Get(ctx, rem.Filepath)
+		if err == nil {
+			if rem.FileID == "" {
+				rem.FileID = stored.FileID
+			}
+			rem.ContentHash = stored.ContentHash
+			err = g.dao.Delete(ctx, rem.Filepath)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	err := g.removeLocal(ctx, rem)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	g.recordAccess(AccessEvict, rem.Filepath, rem.Size)
+	g.audit(ctx, AuditEvict, rem.Filepath, rem.FileID, rem.Size)
+	return nil
+}
+
+// Unpin makes the given paths eligible for eviction again.
+func (g *GDrive) Unpin(paths ...string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	for _, p := range paths {
+		delete(g.pinned, p)
+	}
+}
+
+// AuditSize reports the size recorded in the dao and the actual size of the files on local disk.
+// A large difference between both means the dao has drifted from the local cache.
+func (g *GDrive) AuditSize(ctx context.Context) (daoBytes, diskBytes int64, err error) {
+	if g.dao != nil {
+		daoBytes, err = g.dao.TotalSize(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	err = g.walkLocal(func(rel string, info fs.FileInfo) error {
+		diskBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return daoBytes, diskBytes, nil
+}
+
+// RebuildDAOFromLocal inserts a dao row for every file found in the local folder, so a fresh in-memory dao
+// can still evict files cached by a previous process. The file id is resolved from google drive when reachable.
+func (g *GDrive) RebuildDAOFromLocal(ctx context.Context) error {
+	if g.dao == nil {
+		return nil
+	}
+	return g.walkLocal(func(rel string, info fs.FileInfo) error {
+		contentSize, err := g.localContentSize(rel, info.Size())
+		if err != nil {
+			return err
+		}
+		contentHash, err := g.localContentHash(rel)
+		if err != nil {
+			return err
+		}
+		fileInfo := &FileInfo{LastAccess: info.ModTime(), Filepath: rel, Size: contentSize,
+			StoredSize: storedSize(contentSize, info.Size()), ContentHash: contentHash}
+		if g.service() != nil {
+			if driveFile := g.getFileInCloud(ctx, rel); driveFile != nil {
+				fileInfo.FileID = driveFile.Id
+				fileInfo.MimeType = driveFile.MimeType
+				fileInfo.Description = driveFile.Description
+			}
+		}
+		return g.dao.InsertOrUpdate(ctx, fileInfo)
+	})
+}
+
+// CachedFileCount returns the number of files recorded in the dao, 0 without a dao
+func (g *GDrive) CachedFileCount(ctx context.Context) (int, error) {
+	if g.dao == nil {
+		return 0, nil
+	}
+	return g.dao.Count(ctx)
+}
+
+// SizeByMimeType returns the total cached bytes of each mime type
+func (g *GDrive) SizeByMimeType(ctx context.Context) (map[string]int64, error) {
+	if g.dao == nil {
+		return map[string]int64{}, nil
+	}
+	return g.dao.SizeByMimeType(ctx)
+}
+
+// MigrateTo copies every file recorded in the dao into the destination instance, keeping paths and descriptions.
+// Files that already exist in the destination are skipped, the returned error joins the failed files.
+func (g *GDrive) MigrateTo(ctx context.Context, dst *GDrive) error {
+	files, err := g.allFiles(ctx)
+	if err != nil {
+		return err
+	}
+	chanLimit := make(chan struct{}, g.downloadConcurrency())
+	wg := &sync.WaitGroup{}
+	errMut := sync.Mutex{}
+	errs := []error{}
+	for i := range files {
+		wg.Add(1)
+		go func(fileInfo FileInfo) {
+			chanLimit <- struct{}{}
+			defer func() {
+				wg.Done()
+				<-chanLimit
+			}()
+			b, err := g.readFile(ctx, fileInfo.Filepath)
+			if err == nil {
+				err = dst.StoreFile(ctx, &FileInsertInfo{FileBytes: b, Filepath: fileInfo.Filepath, Description: fileInfo.Description})
+				if errors.Is(err, ErrFileExist) {
+					err = nil
+				}
+			}
+			if err != nil {
+				g.logger().Errorf("unable to migrate file %s: %v", fileInfo.Filepath, err)
+				errMut.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", fileInfo.Filepath, err))
+				errMut.Unlock()
+				return
+			}
+			g.logger().Debugf("file %s migrated", fileInfo.Filepath)
+		}(files[i])
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// UntrackedLocal returns the local files that have no dao row and are therefore never evicted.
+// These are the files RebuildDAOFromLocal would add.
+func (g *GDrive) UntrackedLocal(ctx context.Context) ([]string, error) {
+	files, err := g.allFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]struct{}, len(files))
+	for i := range files {
+		tracked[files[i].Filepath] = struct{}{}
+	}
+	retVal := []string{}
+	err = g.walkLocal(func(rel string, info fs.FileInfo) error {
+		if _, ok := tracked[rel]; !ok {
+			retVal = append(retVal, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retVal, nil
+}
+
+// SetPriority changes the eviction priority of a cached file, lower priorities are evicted first
+func (g *GDrive) SetPriority(ctx context.Context, filePathName string, priority int) error {
+	if g.dao == nil {
+		return nil
+	}
+	return g.dao.SetPriority(ctx, filePathName, priority)
+}
+
+// allFiles returns every file recorded in the dao, oldest first
+func (g *GDrive) allFiles(ctx context.Context) ([]FileInfo, error) {
+	if g.dao == nil {
+		return []FileInfo{}, nil
+	}
+	return g.dao.QueryOldest(ctx, math.MaxInt32)
+}
+
+func (g *GDrive) isPinned(filePathName string) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	_, ok := g.pinned[filePathName]
+	return ok
+}
+
+func (g *GDrive) isDownloading(filePathName string) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	return g.downloading[filePathName] > 0
+}
+
+type uploadOptions struct {
+	replace         bool
+	description     string
+	expectedVersion int64 // 0 skips the version check
+	size            int64 // content length reported to Config.ProgressFunc, -1 when unknown
+	priority        int   // recorded with a resumable session
+}
+
+func (g *GDrive) uploadToCloud(ctx context.Context, filepathName string, reader io.Reader, opts uploadOptions) (*drive.File, error) {
+	var driveFile *drive.File
+	if opts.expectedVersion > 0 {
+		// the version is compared with google drive itself, never with the index
+		driveFile = g.queryRemote(ctx, filepathName)
+	} else {
+		driveFile = g.getFileInCloud(ctx, filepathName)
+	}
+	if driveFile != nil && !opts.replace {
+		return driveFile, nil
+	}
+	if opts.expectedVersion > 0 && (driveFile == nil || driveFile.Version != opts.expectedVersion) {
+		return nil, ErrConflict
+	}
+	var head []byte
+	if mimeTypeByExtension(filepathName) == "" && !g.encodesContent() {
+		var err error
+		head, reader, err = peekHead(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mimeType := g.mimeTypeFor(filepathName, head)
+	reader = g.withProgress(filepathName, reader, opts.size)
+	mediaOptions := []googleapi.MediaOption{}
+	if mimeType != "" {
+		mediaOptions = append(mediaOptions, googleapi.ContentType(mimeType))
+	}
+	upload := func() (res *drive.File, err error) {
+		if driveFile == nil {
+			folderID, name, err := g.remoteLocation(ctx, filepathName, true)
+			if err != nil {
+				return nil, err
+			}
+			return g.withRetryCreate(ctx, reader, func() (*drive.File, error) {
+				return g.findChild(ctx, folderID, name, false)
+			}, func() (*drive.File, error) {
+				return g.filesCreate(
+					&drive.File{
+						Name:        name,
+						Parents:     []string{folderID},
+						Description: opts.description,
+						MimeType:    mimeType,
+					}).
+					Media(reader, mediaOptions...).
+					Fields(uploadFields...).
+					Context(ctx).
+					Do()
+			})
+		}
+		err = g.withRetryReader(ctx, reader, func() (err error) {
+			res, err = g.filesUpdate(driveFile.Id, &drive.File{Description: opts.description}).
+				Media(reader, mediaOptions...).
+				Fields(uploadFields...).
+				Context(ctx).
+				Do()
+			return err
+		})
+		return res, err
+	}
+	defer g.forgetRemote(filepathName)
+	start := time.Now()
+	res, err := upload()
+	// only a rewindable reader can be sent again
+	if seeker, ok := reader.(io.Seeker); ok && isStorageFull(err) && g.config.EvictRemoteOnFull {
+		size, _ := seeker.Seek(0, io.SeekEnd)
+		if g.evictRemote(ctx, filepathName, size) > 0 {
+			res, err = upload()
+		}
+	}
+	if isStorageFull(err) {
+		return nil, fmt.Errorf("%s: %w", filepathName, ErrStorageFull)
+	}
+	if err == nil {
+		g.metrics().ObserveUpload(opts.size, time.Since(start))
+		if res.MimeType == "" {
+			res.MimeType = mimeType
+		}
+	}
+	return res, err
+}
+
+// evictRemote deletes the least recently used files from google drive, the local cache and the dao
+// until at least need bytes are freed, skipping pinned files, files in the eviction grace period, files in use
+// and the file being uploaded. It returns the freed bytes.
+func (g *GDrive) evictRemote(ctx context.Context, uploading string, need int64) int64 {
+	files, err := g.allFiles(ctx)
+	if err != nil {
+		g.logger().Errorf("unable to query oldest from dao: %v", err)
+		return 0
+	}
+	graceCutoff := g.now().Add(-g.config.EvictionGracePeriod)
+	var freed int64
+	for _, f := range files {
+		if freed >= need && freed > 0 {
+			break
+		}
+		if f.FileID == "" || f.Filepath == uploading || g.isPinned(f.Filepath) {
+			continue
+		}
+		if g.config.EvictionGracePeriod > 0 && f.LastAccess.After(graceCutoff) {
+			continue
+		}
+		unlock, inUse := g.claimForEviction(f.Filepath)
+		if inUse {
+			continue
+		}
+		err := g.withRetry(ctx, func() error {
+			return g.filesDelete(f.FileID).Context(ctx).Do()
+		})
+		if err != nil {
+			unlock()
+			g.logger().Errorf("unable to remove %s from google drive: %v", f.Filepath, err)
+			continue
+		}
+		g.dao.Delete(ctx, f.Filepath)
+		g.removeLocal(ctx, f)
+		unlock()
+		g.forgetRemote(f.Filepath)
+		g.recordAccess(AccessEvict, f.Filepath, f.Size)
+		g.audit(ctx, AuditDelete, f.Filepath, f.FileID, f.Size)
+		freed += f.DiskSize()
+	}
+	g.logger().Warnf("google drive is full, evicted %d bytes of remote files", freed)
+	return freed
+}
+
+// verifyUpload compares the size and md5 checksum reported by google drive with the uploaded bytes
+func (g *GDrive) verifyUpload(ctx context.Context, fileID string, b []byte) error {
+	var remote *drive.File
+	err := g.withRetry(ctx, func() (err error) {
+		remote, err = g.filesGet(fileID).Fields("id", "size", "md5Checksum").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(b)
+	if remote.Size != int64(len(b)) || remote.Md5Checksum != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("%s: %w", fileID, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// mimeTypeFor detects the mime type from the file extension, then from the first bytes of the content,
+// falling back to Config.DefaultMimeType. Encrypted or compressed content is never sniffed.
+func (g *GDrive) mimeTypeFor(filepathName string, head []byte) string {
+	if byExt := mimeTypeByExtension(filepathName); byExt != "" {
+		return byExt
+	}
+	if len(head) > 0 && !g.encodesContent() {
+		mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+		if err == nil && mediaType != "application/octet-stream" {
+			return mediaType
+		}
+	}
+	return g.config.DefaultMimeType
+}
+
+func mimeTypeByExtension(filepathName string) string {
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(filepathName)))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// sniffLen is the number of bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// peekHead reads the first bytes of the content for sniffing, the returned reader still yields the whole content
+// and stays rewindable when the given reader is
+func peekHead(reader io.Reader) ([]byte, io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+	head = head[:n]
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(0, io.SeekStart)
+		return head, reader, err
+	}
+	return head, io.MultiReader(bytes.NewReader(head), reader), nil
+}
+
+// readHeadAt reads the first bytes of the content for sniffing
+func readHeadAt(content io.ReaderAt) []byte {
+	head := make([]byte, sniffLen)
+	n, _ := content.ReadAt(head, 0)
+	return head[:n]
+}
+
+func (g *GDrive) getFileInCloud(ctx context.Context, filepathName string) *drive.File {
+	if g.service() == nil {
+		return nil
+	}
+	if driveFile, known := g.indexedRemote(filepathName); known {
+		return driveFile
+	}
+	return g.queryRemote(ctx, filepathName)
+}
+
+// queryRemote looks the file up on google drive without the remote index, for decisions that must not act on
+// changes made elsewhere since the index was loaded
+func (g *GDrive) queryRemote(ctx context.Context, filepathName string) *drive.File {
+	if g.service() == nil {
+		return nil
+	}
+	folderID, name, err := g.remoteLocation(ctx, filepathName, false)
+	if err != nil || folderID == "" {
+		return nil
+	}
+	driveFile, err := g.findChild(ctx, folderID, name, false)
+	if legacy := g.legacyRemoteName(filepathName); err == nil && driveFile == nil && legacy != "" {
+		driveFile, err = g.findChild(ctx, folderID, legacy, false)
+	}
+	if err != nil {
+		return nil
+	}
+	g.setIndexedRemote(filepathName, driveFile)
+	return driveFile
+}
+
+func (g *GDrive) storeFileToLocal(ctx context.Context, filePathName string, bytes []byte) error {
+	localPath := g.localFullPath(filePathName)
+	dir := filepath.Dir(localPath)
+	err := g.mkdirAll(dir)
+	if err != nil {
+		return err
+	}
+	// the whole file replaces the segments of its ranges
+	err = g.removeSegments(filePathName)
+	if err != nil {
+		return err
+	}
+	g.setPlaceholder(filePathName, false)
+	if g.config.ContentAddressedLocal {
+		return g.storeBlob(localPath, bytes)
+	}
+	// write next to the cache file and rename it into place, readers see the old or the new content but never a part
+	tmp, err := g.writeTemp(dir, bytes)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, localPath)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// tmpPrefix starts the names of the temporary files written into the cache folders, walkLocal never lists them
+const tmpPrefix = ".gdrive-tmp-"
+
+// mkdirAll creates the folder and its missing parents with the cache folder mode, whatever the umask is
+func (g *GDrive) mkdirAll(dir string) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		err = g.mkdirAll(parent)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Mkdir(dir, g.dirMode())
+	if os.IsExist(err) {
+		// created meanwhile by another store
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, g.dirMode())
+}
+
+// createTemp creates a uniquely named temporary file in the folder with the cache file mode
+func (g *GDrive) createTemp(dir string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, tmpPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	err = f.Chmod(g.fileMode())
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeTemp writes the bytes to a new temporary file in the folder and returns its path
+func (g *GDrive) writeTemp(dir string, b []byte) (string, error) {
+	f, err := g.createTemp(dir)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (g *GDrive) fileMode() os.FileMode {
+	if g.config.FileMode != 0 {
+		return g.config.FileMode
+	}
+	return defaultFileMode
+}
+
+func (g *GDrive) dirMode() os.FileMode {
+	if g.config.DirMode != 0 {
+		return g.config.DirMode
+	}
+	return defaultDirMode
+}
+
+func (g *GDrive) localFileExist(filePathName string) bool {
+	localPath := g.localFullPath(filePathName)
+	_, err := os.Stat(localPath)
+	if err != nil && os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+// walkLocal calls fn for every regular file under the local root with its slash separated relative path
+func (g *GDrive) walkLocal(fn func(rel string, info fs.FileInfo) error) error {
+	return filepath.Walk(g.config.LocalFolderRoot, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if g.isBlobFolder(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// a temporary file is not cached yet, or was left behind by a crash
+		if strings.HasPrefix(info.Name(), tmpPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(g.config.LocalFolderRoot, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+// partitionPath prefixes the path with the date partition when Config.DatePartition is set
+func (g *GDrive) partitionPath(filePathName string, t time.Time) string {
+	if g.config.DatePartition == "" {
+		return filePathName
+	}
+	return path.Join(t.Format(g.config.DatePartition), filePathName)
+}
+
+// cleanDir cleans a folder path relative to the cache root. The root itself, absolute paths and paths leaving
+// the root fail with ErrInvalidPath.
+func (g *GDrive) cleanDir(dir string) (string, error) {
+	cleaned := path.Clean(dir)
+	if dir == "" || cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%q: %w", dir, ErrInvalidPath)
+	}
+	rel, err := filepath.Rel(g.config.LocalFolderRoot, g.localFullPath(cleaned))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q: %w", dir, ErrInvalidPath)
+	}
+	return cleaned, nil
+}
+
+func (g *GDrive) localFullPath(pathName string) string {
+	return path.Join(g.config.LocalFolderRoot, pathName)
+}
+
+func (g *GDrive) getFolderName(name string) string {
+	return folderPrefix + name
+}
+
+// the flat remote names use # as the path separator, a literal # or % in the path is percent encoded
+// so names stay reversible while paths without them keep their old names
+var (
+	remoteNameEncoder = strings.NewReplacer("%", "%25", "#", "%23", "/", "#")
+	remoteNameDecoder = strings.NewReplacer("#", "/", "%23", "#", "%25", "%")
+)
+
+func (g *GDrive) convertToGDrive(path string) string {
+	return remoteNameEncoder.Replace(path)
+}
+
+// escapeDriveQuery escapes a value used inside a single quoted string of a google drive query
+func escapeDriveQuery(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+func (g *GDrive) convertFromGDrive(name string) string {
+	return remoteNameDecoder.Replace(name)
+}
+
+// legacyRemoteName returns the flat name stored before # and % were encoded, empty when it is the current name
+func (g *GDrive) legacyRemoteName(filePathName string) string {
+	if g.config.UseNativeFolders {
+		return ""
+	}
+	legacy := strings.ReplaceAll(filePathName, "/", "#")
+	if legacy == g.convertToGDrive(filePathName) {
+		return ""
+	}
+	return legacy
+}
+
+// shouldRemove runs one eviction pass bounded by Config.EvictionTimeout,
+// it returns true when the pass could not free enough space and should run again shortly
+func (g *GDrive) shouldRemove() bool {
+	ctx := g.ctx
+	if g.config.EvictionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.config.EvictionTimeout)
+		defer cancel()
+	}
+	g.expireOnce(ctx)
+	retVal := g.evictOnce(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		g.logger().Warnf("eviction pass timed out after %s", g.config.EvictionTimeout)
+	}
+	return retVal
+}
+
+func (g *GDrive) evictOnce(ctx context.Context) bool {
+	evicted := 0
+	defer func() {
+		if evicted > 0 {
+			g.metrics().IncEviction(evicted)
+		}
+	}()
+	if g.dao == nil {
+		return false
+	}
+	// no size budget means no size based eviction
+	var diff int64
+	if maxSize := g.totalMaxSize(); maxSize > 0 {
+		total, err := g.dao.TotalSize(ctx)
+		if err != nil {
+			g.logger().Errorf("unable to get total size from dao: %v", err)
+			return false
+		}
+		// cached segments count toward the budget as well
+		segmentsSize, err := g.segmentsSize()
+		if err != nil {
+			g.logger().Errorf("unable to get size of segments: %v", err)
+			return false
+		}
+		total += segmentsSize
+		if total > maxSize && segmentsSize > 0 {
+			// partial copies go before whole files
+			total -= g.evictSegments(total - g.evictionTarget(maxSize))
+		}
+		if total > maxSize {
+			g.logger().Debugf("total size %d exceeded %d", total, maxSize)
+			// free down to the target so the next stores do not trigger another eviction right away
+			diff = total - g.evictionTarget(maxSize)
+		}
+	}
+	// the file count is bounded independently of the size
+	var countDiff int
+	if maxCount := g.maxFileCount(); maxCount > 0 {
+		count, err := g.dao.Count(ctx)
+		if err != nil {
+			g.logger().Errorf("unable to count files in dao: %v", err)
+			return false
+		}
+		if count > maxCount {
+			g.logger().Debugf("file count %d exceeded %d", count, maxCount)
+			countDiff = count - maxCount
+		}
+	}
+	if diff <= 0 && countDiff <= 0 {
+		return false
+	}
+
+	var totalToRemove, skippedBytes int64
+	removedFiles, skippedFiles := 0, 0
+	policy := g.evictionPolicy()
+	// files accessed within the grace period are never evicted
+	graceCutoff := g.now().Add(-g.config.EvictionGracePeriod)
+	selected := 0
+	// keep selecting until both limits are satisfied, a single pass frees everything needed
+	for round := 0; round < maxEvictionRounds; round++ {
+		// skipped files are selected again, ask for enough to cover them
+		var list []FileInfo
+		var err error
+		if totalToRemove < diff {
+			list, err = policy.Select(ctx, g.dao, diff-totalToRemove+skippedBytes)
+		} else {
+			// the size is back under the limit, the first files of the policy go until the count is as well
+			list, err = selectCount(ctx, policy, g.dao, countDiff-removedFiles+skippedFiles)
+		}
+		if err != nil {
+			g.logger().Errorf("unable to select files to evict: %v", err)
+			return false
+		}
+		skippedBytes, skippedFiles = 0, 0
+		downloading := false
+		toRemove := []FileInfo{}
+		// the selected files stay locked until they are removed, so no read or store of them runs meanwhile
+		unlocks := []func(){}
+		for i := range list {
+			inGrace := g.config.EvictionGracePeriod > 0 && list[i].LastAccess.After(graceCutoff)
+			inUse := false
+			if !inGrace && !g.isPinned(list[i].Filepath) {
+				var unlock func()
+				unlock, inUse = g.claimForEviction(list[i].Filepath)
+				if !inUse {
+					unlocks = append(unlocks, unlock)
+					totalToRemove += list[i].DiskSize()
+					toRemove = append(toRemove, list[i])
+					if totalToRemove >= diff && removedFiles+len(toRemove) >= countDiff {
+						break
+					}
+					continue
+				}
+			}
+			downloading = downloading || inUse
+			skippedBytes += list[i].DiskSize()
+			skippedFiles++
+		}
+		if len(toRemove) == 0 {
+			if len(list) <= selected {
+				// nothing left that can be evicted, a file being downloaded may be evictable shortly
+				return downloading
+			}
+			// every candidate was skipped, ask for more
+			selected = len(list)
+			continue
+		}
+		selected = 0
+		removed, err := g.removeEvicted(ctx, toRemove)
+		for _, unlock := range unlocks {
+			unlock()
+		}
+		evicted += removed
+		removedFiles += removed
+		if err != nil {
+			return false
+		}
+		if totalToRemove >= diff && removedFiles >= countDiff {
+			return false
+		}
+	}
+	// max rounds reached, let the worker continue shortly
+	g.logger().Debugf("eviction stopped after %d rounds", maxEvictionRounds)
+	return true
+}
+
+// claimForEviction locks the file until it is removed, inUse is true when a download or another operation has it
+func (g *GDrive) claimForEviction(filePathName string) (unlock func(), inUse bool) {
+	if g.isDownloading(filePathName) {
+		return nil, true
+	}
+	unlock, ok := g.pathLocks.tryLock(filePathName)
+	return unlock, !ok
+}
+
+// removeEvicted removes the evicted files from the dao and the local folder and returns how many were removed,
+// it stops at the first failure
+func (g *GDrive) removeEvicted(ctx context.Context, files []FileInfo) (int, error) {
+	for i, rem := range files {
+		if ctx.Err() != nil {
+			return i, ctx.Err()
+		}
+		err := g.dao.Delete(ctx, rem.Filepath)
+		if err != nil {
+			g.logger().Errorf("unable to remove from dao: %v", err)
+			return i, err
+		}
+		err = g.removeLocal(ctx, rem)
+		if err != nil {
+			g.logger().Errorf("unable to remove file: %v", err)
+			return i, err
+		}
+		g.recordAccess(AccessEvict, rem.Filepath, rem.Size)
+		g.audit(ctx, AuditEvict, rem.Filepath, rem.FileID, rem.Size)
+	}
+	return len(files), nil
+}
+
+// this only for testing
+func (g *GDrive) deleteRootFolder(ctx context.Context, force bool) error {
+	if !g.createdParent && !force {
+		return ErrFolderNotOwned
+	}
+	return g.filesDelete(g.parentFolderID).Context(ctx).Do()
 }
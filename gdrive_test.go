@@ -1,17 +1,34 @@
 package gdrive
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
 )
 
 type GDriveTestSuite struct {
@@ -40,7 +57,7 @@ func (s *GDriveTestSuite) SetupSuite() {
 }
 
 func (s *GDriveTestSuite) TearDownSuite() {
-	err := s.instance.deleteRootFolder(context.Background())
+	err := s.instance.deleteRootFolder(context.Background(), true)
 	s.Require().NoError(err)
 	err = os.RemoveAll(s.localFolder)
 	s.Require().NoError(err)
@@ -119,7 +136,7 @@ func (s *GDriveTestSuite) TestUploadAll() {
 	}
 	fmt.Println(total)
 
-	err = instance.deleteRootFolder(context.TODO())
+	err = instance.deleteRootFolder(context.TODO(), true)
 	s.Require().NoError(err)
 	err = os.RemoveAll(localFolder)
 	s.Require().NoError(err)
@@ -189,7 +206,7 @@ func (s *GDriveTestSuite) TestWorker() {
 	fileExist = instance.localFileExist(paths[2])
 	s.Require().False(fileExist)
 
-	err = instance.deleteRootFolder(context.TODO())
+	err = instance.deleteRootFolder(context.TODO(), true)
 	s.Require().NoError(err)
 	err = os.RemoveAll(localFolder)
 	s.Require().NoError(err)
@@ -235,3 +252,3113 @@ func createInstance(credentialFile, tokenFile string, cfg *Config, dao Dao) (*GD
 	err = instance.Init()
 	return instance, err
 }
+
+func TestDeleteRootFolderNotOwned(t *testing.T) {
+	cfg := &Config{RemoteFolderRoot: "shared"}
+	owner, fake := newFakeInstance(t, cfg, nil)
+	require.True(t, owner.createdParent)
+
+	instance := &GDrive{ctx: context.Background(), config: cfg, driveService: owner.driveService}
+	err := instance.Init()
+	require.NoError(t, err)
+	require.Equal(t, owner.parentFolderID, instance.parentFolderID)
+
+	err = instance.deleteRootFolder(context.TODO(), false)
+	require.ErrorIs(t, err, ErrFolderNotOwned)
+	require.Equal(t, 0, fake.callCount("delete"))
+
+	err = instance.deleteRootFolder(context.TODO(), true)
+	require.NoError(t, err)
+	require.Equal(t, 1, fake.callCount("delete"))
+}
+
+func TestStoreFileConcurrentDedup(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	createBefore := fake.callCount("create")
+
+	wg := &sync.WaitGroup{}
+	start := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "folder/same.txt", FileBytes: []byte("same content")})
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	require.Equal(t, 1, fake.callCount("create")-createBefore)
+	require.True(t, instance.localFileExist("folder/same.txt"))
+}
+
+// waitFor polls the condition until it holds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 1000 && !cond(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, cond())
+}
+
+// lockWaiters returns the number of holders and waiters of the path lock
+func lockWaiters(instance *GDrive, key string) int {
+	instance.pathLocks.mut.Lock()
+	defer instance.pathLocks.mut.Unlock()
+	if l, ok := instance.pathLocks.locks[key]; ok {
+		return l.refs
+	}
+	return 0
+}
+
+func TestStoreFileSharedCancel(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	unlock := instance.pathLocks.lock("a.txt")
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	store := func(ctx context.Context) {
+		errs <- instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")})
+	}
+	go store(leaderCtx)
+	waitFor(t, func() bool { return lockWaiters(instance, "a.txt") == 2 })
+	go store(context.TODO())
+	waitFor(t, func() bool {
+		instance.mut.Lock()
+		defer instance.mut.Unlock()
+		for _, shared := range instance.storeCalls {
+			return shared.callers == 2
+		}
+		return false
+	})
+
+	// the leader gives up, the shared upload goes on for the other caller
+	cancel()
+	require.ErrorIs(t, <-errs, context.Canceled)
+	unlock()
+	require.NoError(t, <-errs)
+	require.True(t, instance.localFileExist("a.txt"))
+	require.NotNil(t, instance.getFileInCloud(context.TODO(), "a.txt"))
+}
+
+func TestStoreFileNotShared(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")}))
+	version := instance.getFileInCloud(ctx, "a.txt").Version
+
+	// each version check runs on its own
+	unlock := instance.pathLocks.lock("a.txt")
+	errs := make(chan error, 2)
+	for _, expected := range []int64{version, version + 100} {
+		go func(expected int64) {
+			errs <- instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("b"), Replace: true, ExpectedVersion: expected})
+		}(expected)
+	}
+	waitFor(t, func() bool { return lockWaiters(instance, "a.txt") == 3 })
+	unlock()
+	results := []error{<-errs, <-errs}
+	require.Contains(t, results, nil)
+	require.True(t, errors.Is(results[0], ErrConflict) || errors.Is(results[1], ErrConflict))
+
+	// each versioned store gets its own version
+	instance.config.ConflictMode = ConflictVersion
+	unlock = instance.pathLocks.lock("a.txt")
+	infos := []*FileInsertInfo{{Filepath: "a.txt", FileBytes: []byte("c")}, {Filepath: "a.txt", FileBytes: []byte("c")}}
+	for _, info := range infos {
+		go func(info *FileInsertInfo) {
+			errs <- instance.StoreFile(ctx, info)
+		}(info)
+	}
+	waitFor(t, func() bool { return lockWaiters(instance, "a.txt") == 3 })
+	unlock()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	require.ElementsMatch(t, []string{"a (1).txt", "a (2).txt"}, []string{infos[0].StoredPath, infos[1].StoredPath})
+}
+
+func TestStoreFileDatePartition(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{DatePartition: "2006/01/02"}, NewMemoryDao())
+	info := &FileInsertInfo{Filepath: "metrics.json", FileBytes: []byte("{}")}
+	err := instance.StoreFile(context.TODO(), info)
+	require.NoError(t, err)
+	require.Equal(t, path.Join(time.Now().Format("2006/01/02"), "metrics.json"), info.StoredPath)
+	require.True(t, instance.localFileExist(info.StoredPath))
+	require.NotNil(t, instance.getFileInCloud(context.TODO(), info.StoredPath))
+}
+
+func TestResumePendingUploads(t *testing.T) {
+	cfg := &Config{
+		ResumableThreshold: 1,
+		UploadChunkSize:    256 * 1024,
+		UploadStateFile:    path.Join(t.TempDir(), "uploads.json"),
+		MaxRetries:         -1, // a failed chunk is not resumed in process
+	}
+	instance, fake := newFakeInstance(t, cfg, nil)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1 MiB, four chunks
+	err := instance.storeFileToLocal(context.TODO(), "big.bin", content)
+	require.NoError(t, err)
+
+	// the second chunk fails, leaving a pending session behind
+	fake.failChunk = 2
+	err = instance.UploadAll(context.TODO())
+	require.Error(t, err)
+	require.Nil(t, instance.getFileInCloud(context.TODO(), "big.bin"))
+	require.FileExists(t, cfg.UploadStateFile)
+
+	// a new process resumes from the committed offset
+	dao := NewMemoryDao()
+	restarted := &GDrive{ctx: context.Background(), config: cfg, dao: dao, httpClient: instance.httpClient,
+		driveService: instance.driveService, parentFolderID: instance.parentFolderID}
+	err = restarted.ResumePendingUploads(context.TODO())
+	require.NoError(t, err)
+
+	cloudFile := restarted.getFileInCloud(context.TODO(), "big.bin")
+	require.NotNil(t, cloudFile)
+	require.Equal(t, int64(len(content)), cloudFile.Size)
+	require.Equal(t, len(content), fake.receivedBytes)
+	total, err := dao.TotalSize(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), total)
+
+	b, err := os.ReadFile(cfg.UploadStateFile)
+	require.NoError(t, err)
+	require.Equal(t, "[]", string(b))
+}
+
+func TestResumeStoreFile(t *testing.T) {
+	cfg := &Config{
+		ResumableThreshold:    1,
+		UploadChunkSize:       256 * 1024,
+		UploadStateFile:       path.Join(t.TempDir(), "uploads.json"),
+		MaxRetries:            -1,
+		EncryptionKey:         bytes.Repeat([]byte("k"), 32),
+		ContentAddressedLocal: true,
+	}
+	instance, fake := newFakeInstance(t, cfg, NewMemoryDao())
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	ctx := context.TODO()
+
+	// the store fails after the first chunk, the session and the local file are kept for the resume
+	fake.failChunk = 2
+	err := instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.bin", FileBytes: content, Priority: 2})
+	require.Error(t, err)
+	require.True(t, instance.localFileExist("big.bin"))
+
+	dao := NewMemoryDao()
+	restarted := &GDrive{ctx: context.Background(), config: cfg, dao: dao, aead: instance.aead, httpClient: instance.httpClient,
+		driveService: instance.driveService, parentFolderID: instance.parentFolderID}
+	require.NoError(t, restarted.ResumePendingUploads(ctx))
+
+	stored, err := dao.Get(ctx, "big.bin")
+	require.NoError(t, err)
+	cloudFile := restarted.getFileInCloud(ctx, "big.bin")
+	require.NotNil(t, cloudFile)
+	require.Equal(t, cloudFile.Id, stored.FileID)
+	require.Equal(t, int64(len(content)), stored.Size)
+	require.Equal(t, cloudFile.Size, stored.StoredSize)
+	require.Equal(t, cloudFile.Md5Checksum, stored.Md5)
+	require.Equal(t, cloudFile.Version, stored.Version)
+	require.Equal(t, 2, stored.Priority)
+	local, err := os.ReadFile(instance.localFullPath("big.bin"))
+	require.NoError(t, err)
+	require.Equal(t, restarted.contentHash(local), stored.ContentHash)
+	b, err := restarted.ReadFile(ctx, "big.bin")
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+
+	// a failure before the session started leaves nothing behind
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Error(t, restarted.StoreFile(cancelled, &FileInsertInfo{Filepath: "other.bin", FileBytes: content}))
+	require.False(t, restarted.localFileExist("other.bin"))
+}
+
+func TestResumableStoreWithoutDao(t *testing.T) {
+	stateDir := path.Join(t.TempDir(), "state")
+	cfg := &Config{ResumableThreshold: 1, UploadStateFile: path.Join(stateDir, "uploads.json"), MaxRetries: -1,
+		ContentAddressedLocal: true, DirMode: 0777}
+	instance, _ := newFakeInstance(t, cfg, nil)
+	ctx := context.TODO()
+	content := []byte("content")
+
+	// a failure before the session started removes the local file and its blob
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Error(t, instance.StoreFile(cancelled, &FileInsertInfo{Filepath: "a.bin", FileBytes: content}))
+	require.False(t, instance.localFileExist("a.bin"))
+	_, err := os.Stat(instance.blobPath(instance.contentHash(content)))
+	require.True(t, os.IsNotExist(err))
+
+	// the folder of the session state has the cache folder mode
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.bin", FileBytes: content}))
+	info, err := os.Stat(stateDir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0777), info.Mode().Perm())
+}
+
+func TestTouchFileMissing(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	err := instance.TouchFile(context.TODO(), "missing.txt")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	instance.config.TouchMissing = TouchMissingIgnore
+	err = instance.TouchFile(context.TODO(), "missing.txt")
+	require.NoError(t, err)
+	require.False(t, instance.localFileExist("missing.txt"))
+
+	instance.config.TouchMissing = TouchMissingPlaceholder
+	err = instance.TouchFile(context.TODO(), "missing.txt")
+	require.NoError(t, err)
+	require.True(t, instance.localFileExist("missing.txt"))
+}
+
+func TestTouchMissingPlaceholder(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{TouchMissing: TouchMissingPlaceholder}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.TouchFile(ctx, "a.txt"))
+	require.NoError(t, instance.TouchFile(ctx, "b.txt"))
+
+	// the placeholders are never uploaded
+	result, err := instance.UploadAllWithResult(ctx)
+	require.NoError(t, err)
+	require.Empty(t, result.Uploaded)
+	require.Nil(t, instance.getFileInCloud(ctx, "a.txt"))
+
+	// a store overwrites the placeholder without Replace
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")}))
+	b, err := instance.ReadFile(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), b)
+	err = instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("again")})
+	require.ErrorIs(t, err, ErrFileExist)
+
+	// the dao still knows the placeholder after a restart
+	instance.placeholders = map[string]struct{}{}
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("b")}))
+	fileInfo, err := instance.dao.Get(ctx, "b.txt")
+	require.NoError(t, err)
+	require.False(t, fileInfo.Placeholder)
+}
+
+func TestStoreFileExpectedVersion(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, nil)
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "doc.txt", FileBytes: []byte("v1")})
+	require.NoError(t, err)
+	version := instance.getFileInCloud(context.TODO(), "doc.txt").Version
+
+	err = instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "doc.txt", FileBytes: []byte("v2"), Replace: true,
+		ExpectedVersion: version})
+	require.NoError(t, err)
+
+	// the version is stale now
+	err = instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "doc.txt", FileBytes: []byte("v3"), Replace: true,
+		ExpectedVersion: version})
+	require.ErrorIs(t, err, ErrConflict)
+}
+
+func TestStoreFileExpectedVersionIndexed(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "doc.txt", FileBytes: []byte("v1")}))
+	require.NoError(t, instance.RefreshRemoteIndex(ctx))
+	driveFile := instance.getFileInCloud(ctx, "doc.txt")
+	version := driveFile.Version
+
+	// another writer updates the file after the index was loaded
+	fake.mut.Lock()
+	fake.files[driveFile.Id].meta.Version++
+	fake.mut.Unlock()
+
+	err := instance.StoreFile(ctx, &FileInsertInfo{Filepath: "doc.txt", FileBytes: []byte("v2"), Replace: true,
+		ExpectedVersion: version})
+	require.ErrorIs(t, err, ErrConflict)
+}
+
+func TestStreamFiles(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{DownloadConcurrency: 2}, NewMemoryDao())
+	for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+		err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: p, FileBytes: []byte("content " + p)})
+		require.NoError(t, err)
+	}
+	// evict one file locally so it has to be downloaded
+	err := os.Remove(instance.localFullPath("b.txt"))
+	require.NoError(t, err)
+
+	results, err := instance.StreamFiles(context.TODO(), []string{"a.txt", "b.txt", "c.txt", "missing.txt"})
+	require.NoError(t, err)
+	got := map[string]FileResult{}
+	for res := range results {
+		got[res.Filepath] = res
+	}
+	require.Len(t, got, 4)
+	for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+		require.NoError(t, got[p].Err)
+		require.Equal(t, "content "+p, string(got[p].Bytes))
+	}
+	require.ErrorIs(t, got["missing.txt"].Err, ErrNotFound)
+	require.True(t, instance.localFileExist("b.txt"))
+}
+
+func TestZeroMaxSizeDoesNotEvict(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 0}, dao)
+	for _, p := range []string{"a.txt", "b.txt"} {
+		err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: p, FileBytes: []byte("some content")})
+		require.NoError(t, err)
+	}
+	require.False(t, instance.shouldRemove())
+	require.True(t, instance.localFileExist("a.txt"))
+	require.True(t, instance.localFileExist("b.txt"))
+	total, err := dao.TotalSize(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, int64(24), total)
+}
+
+func TestMoveRemoteRoot(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, nil)
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")})
+	require.NoError(t, err)
+
+	err = instance.MoveRemoteRoot(context.TODO(), "newparent")
+	require.NoError(t, err)
+	require.Equal(t, []string{"newparent"}, fake.files[instance.parentFolderID].meta.Parents)
+	require.NotNil(t, instance.getFileInCloud(context.TODO(), "a.txt"))
+}
+
+func TestUpdateConfig(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 1000}, dao)
+	for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+		err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: p, FileBytes: []byte("0123456789")})
+		require.NoError(t, err)
+	}
+
+	root := "other"
+	err := instance.UpdateConfig(ConfigPatch{RemoteFolderRoot: &root})
+	require.ErrorIs(t, err, ErrImmutableConfig)
+
+	go instance.Start()
+	maxSize := int64(15)
+	interval := 10 * time.Millisecond
+	err = instance.UpdateConfig(ConfigPatch{TotalMaxSize: &maxSize, EvictionInterval: &interval})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		total, err := dao.TotalSize(context.TODO())
+		return err == nil && total <= maxSize
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDownloadRangeSegments(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{SegmentFolder: t.TempDir()}, nil)
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "archive.bin", FileBytes: content})
+	require.NoError(t, err)
+	err = os.Remove(instance.localFullPath("archive.bin"))
+	require.NoError(t, err)
+
+	b, err := instance.DownloadRange(context.TODO(), "archive.bin", 10, 10)
+	require.NoError(t, err)
+	require.Equal(t, content[10:20], b)
+	require.Equal(t, 10, fake.downloadedBytes)
+
+	// only the gap after the cached segment is fetched
+	b, err = instance.DownloadRange(context.TODO(), "archive.bin", 15, 15)
+	require.NoError(t, err)
+	require.Equal(t, content[15:30], b)
+	require.Equal(t, 20, fake.downloadedBytes)
+
+	// fully cached, nothing is fetched
+	b, err = instance.DownloadRange(context.TODO(), "archive.bin", 12, 16)
+	require.NoError(t, err)
+	require.Equal(t, content[12:28], b)
+	require.Equal(t, 20, fake.downloadedBytes)
+
+	// the length is clamped to the end of the file
+	b, err = instance.DownloadRange(context.TODO(), "archive.bin", 30, 100)
+	require.NoError(t, err)
+	require.Equal(t, content[30:], b)
+}
+
+func TestDownloadRangeHugeLength(t *testing.T) {
+	for _, cfg := range []*Config{{}, {SegmentFolder: t.TempDir()}, {EncryptionKey: bytes.Repeat([]byte("k"), 32)}} {
+		instance, _ := newFakeInstance(t, cfg, nil)
+		ctx := context.TODO()
+		content := []byte("0123456789")
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: content}))
+		b, err := instance.DownloadRange(ctx, "a.txt", 2, 1<<62)
+		require.NoError(t, err)
+		require.Equal(t, content[2:], b)
+		b, err = instance.DownloadRange(ctx, "a.txt", 2, math.MaxInt64)
+		require.NoError(t, err)
+		require.Equal(t, content[2:], b)
+
+		// the remote range is clamped as well
+		require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+		b, err = instance.DownloadRange(ctx, "a.txt", 2, math.MaxInt64)
+		require.NoError(t, err)
+		require.Equal(t, content[2:], b)
+	}
+}
+
+func TestSegmentsInvalidated(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{SegmentFolder: t.TempDir()}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")}))
+	cacheRange := func() {
+		require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+		_, err := instance.DownloadRange(ctx, "a.txt", 0, 5)
+		require.NoError(t, err)
+		segments, err := instance.segments("a.txt")
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+	}
+
+	// a replaced file never serves the ranges of its old content
+	cacheRange()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("abcdefghij"), Replace: true}))
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+	b, err := instance.DownloadRange(ctx, "a.txt", 0, 5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("abcde"), b)
+
+	require.NoError(t, instance.DeleteFile(ctx, "a.txt"))
+	segments, err := instance.segments("a.txt")
+	require.NoError(t, err)
+	require.Empty(t, segments)
+}
+
+func TestSegmentsEviction(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{SegmentFolder: t.TempDir(), TotalMaxSize: 25}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")}))
+	// b.txt is only known to google drive
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: bytes.Repeat([]byte("x"), 30)}))
+	require.NoError(t, os.Remove(instance.localFullPath("b.txt")))
+	require.NoError(t, dao.Delete(ctx, "b.txt"))
+	_, err := instance.DownloadRange(ctx, "b.txt", 0, 20)
+	require.NoError(t, err)
+
+	// the files are within the budget, the segments are not
+	size, err := instance.segmentsSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(20), size)
+	instance.shouldRemove()
+	size, err = instance.segmentsSize()
+	require.NoError(t, err)
+	require.Zero(t, size)
+	require.True(t, instance.localFileExist("a.txt"))
+}
+
+func TestMigrateTo(t *testing.T) {
+	src, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	dst, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	paths := []string{"a.txt", "folder/b.txt"}
+	for _, p := range paths {
+		err := src.StoreFile(context.TODO(), &FileInsertInfo{Filepath: p, FileBytes: []byte("content " + p), Description: "desc"})
+		require.NoError(t, err)
+	}
+
+	err := src.MigrateTo(context.TODO(), dst)
+	require.NoError(t, err)
+	for _, p := range paths {
+		cloudFile := dst.getFileInCloud(context.TODO(), p)
+		require.NotNil(t, cloudFile)
+		require.Equal(t, "desc", cloudFile.Description)
+		b, err := os.ReadFile(dst.localFullPath(p))
+		require.NoError(t, err)
+		require.Equal(t, "content "+p, string(b))
+	}
+
+	// running again skips the migrated files
+	err = src.MigrateTo(context.TODO(), dst)
+	require.NoError(t, err)
+}
+
+func TestEvictionGracePeriod(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 10, EvictionGracePeriod: time.Hour}, dao)
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "old.txt", FileBytes: []byte("0123456789")})
+	require.NoError(t, err)
+	err = instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "new.txt", FileBytes: []byte("0123456789")})
+	require.NoError(t, err)
+
+	// both files are within the grace period
+	instance.shouldRemove()
+	require.True(t, instance.localFileExist("old.txt"))
+	require.True(t, instance.localFileExist("new.txt"))
+
+	dao.Touch(context.TODO(), "old.txt", time.Now().Add(-2*time.Hour))
+	instance.shouldRemove()
+	require.False(t, instance.localFileExist("old.txt"))
+	require.True(t, instance.localFileExist("new.txt"))
+}
+
+func TestAccessRecorder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 15, AccessRecorder: NewJSONAccessRecorder(buf)}, NewMemoryDao())
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")})
+	require.NoError(t, err)
+	err = instance.TouchFile(context.TODO(), "a.txt")
+	require.NoError(t, err)
+	err = instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("0123456789")})
+	require.NoError(t, err)
+	instance.shouldRemove()
+
+	ops := []string{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		event := AccessEvent{}
+		require.NoError(t, dec.Decode(&event))
+		require.Equal(t, int64(10), event.Size)
+		ops = append(ops, event.Op+" "+event.Filepath)
+	}
+	require.Equal(t, []string{"store a.txt", "touch a.txt", "store b.txt", "evict a.txt"}, ops)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestAccessRecorderError(t *testing.T) {
+	logger := &captureLogger{}
+	instance, _ := newFakeInstance(t, &Config{Logger: logger, AccessRecorder: NewCSVAccessRecorder(failingWriter{})},
+		NewMemoryDao())
+	require.NoError(t, instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")}))
+
+	logger.mut.Lock()
+	defer logger.mut.Unlock()
+	require.Contains(t, logger.messages, "error unable to record access event: disk full")
+}
+
+func TestUntrackedLocal(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "tracked.txt", FileBytes: []byte("tracked")})
+	require.NoError(t, err)
+	err = instance.storeFileToLocal(context.TODO(), "folder/dropped.txt", []byte("dropped"))
+	require.NoError(t, err)
+
+	untracked, err := instance.UntrackedLocal(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, []string{"folder/dropped.txt"}, untracked)
+
+	err = instance.RebuildDAOFromLocal(context.TODO())
+	require.NoError(t, err)
+	untracked, err = instance.UntrackedLocal(context.TODO())
+	require.NoError(t, err)
+	require.Empty(t, untracked)
+}
+
+func TestMaxConcurrentAPICalls(t *testing.T) {
+	var inFlight, maxInFlight int32
+	mut := sync.Mutex{}
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mut.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mut.Lock()
+		inFlight--
+		mut.Unlock()
+		w.Write([]byte("{}"))
+	})
+	srv := httptest.NewServer(slow)
+	defer srv.Close()
+
+	g := &GDrive{config: &Config{MaxConcurrentAPICalls: 2}}
+	client := g.limitClient(srv.Client())
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), maxInFlight)
+}
+
+func TestUpdateConfigLimits(t *testing.T) {
+	var inFlight, maxInFlight int32
+	mut := sync.Mutex{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mut.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mut.Lock()
+		inFlight--
+		mut.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	// the client is created without limits and they are set afterwards
+	g := &GDrive{config: &Config{}}
+	client := g.limitClient(srv.Client())
+	calls, perSecond, uploads := 2, 1000.0, 3
+	require.NoError(t, g.UpdateConfig(ConfigPatch{MaxConcurrentAPICalls: &calls, RequestsPerSecond: &perSecond,
+		UploadConcurrency: &uploads}))
+	require.Equal(t, rate.Limit(1000), g.apiLimiter.Limit())
+	require.Equal(t, 3, g.uploadConcurrency())
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), maxInFlight)
+}
+
+func TestRequestsPerSecond(t *testing.T) {
+	mut := sync.Mutex{}
+	times := []time.Time{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		times = append(times, time.Now())
+		mut.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	g := &GDrive{config: &Config{RequestsPerSecond: 20, MaxConcurrentAPICalls: 4}}
+	client := g.limitClient(srv.Client())
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, times, 6)
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	// a burst of one, every following request waits 50ms for its token
+	require.GreaterOrEqual(t, times[5].Sub(times[0]), 240*time.Millisecond)
+}
+
+func TestVerifyParent(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, nil)
+	oldID := instance.parentFolderID
+	err := instance.VerifyParent(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, oldID, instance.parentFolderID)
+
+	fake.delete(oldID)
+	err = instance.VerifyParent(context.TODO())
+	require.NoError(t, err)
+	require.NotEqual(t, oldID, instance.parentFolderID)
+	require.Contains(t, fake.files, instance.parentFolderID)
+}
+
+type slowDeleteDao struct {
+	*Memory
+}
+
+func (d *slowDeleteDao) Delete(ctx context.Context, filepathName string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestEvictionTimeout(t *testing.T) {
+	dao := &slowDeleteDao{Memory: NewMemoryDao()}
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 5, EvictionTimeout: 50 * time.Millisecond}, dao)
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		instance.shouldRemove()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("eviction pass did not time out")
+	}
+	require.True(t, instance.localFileExist("a.txt"))
+}
+
+func TestAccountInfo(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, nil)
+	email, err := instance.AccountInfo(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, "fake@example.com", email)
+}
+
+func TestDefaultMimeType(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{DefaultMimeType: "application/x-custom"}, dao)
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "noextension", FileBytes: []byte{0, 1, 2, 3}})
+	require.NoError(t, err)
+	err = instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "note.txt", FileBytes: []byte("data")})
+	require.NoError(t, err)
+
+	sizes, err := dao.SizeByMimeType(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"application/x-custom": 4, "text/plain": 4}, sizes)
+}
+
+func TestRenameRemoteRoot(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, nil)
+	folderID := instance.parentFolderID
+	err := instance.RenameRemoteRoot(context.TODO(), "renamed")
+	require.NoError(t, err)
+	require.Equal(t, "gdrive-renamed", fake.files[folderID].meta.Name)
+
+	err = instance.Init()
+	require.NoError(t, err)
+	require.Equal(t, folderID, instance.parentFolderID)
+}
+
+func TestUploadAllStreamsFiles(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{}, dao)
+	content := bytes.Repeat([]byte("x"), 1024*1024)
+	err := instance.storeFileToLocal(context.TODO(), "big.bin", content)
+	require.NoError(t, err)
+
+	err = instance.UploadAll(context.TODO())
+	require.NoError(t, err)
+	cloudFile := instance.getFileInCloud(context.TODO(), "big.bin")
+	require.NotNil(t, cloudFile)
+	require.Equal(t, content, fake.files[cloudFile.Id].content)
+	total, err := dao.TotalSize(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), total)
+}
+
+func TestVerifyAfterUpload(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{VerifyAfterUpload: true}, NewMemoryDao())
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "good.txt", FileBytes: []byte("content")})
+	require.NoError(t, err)
+
+	fake.corruptUploads = true
+	err = instance.StoreFile(context.TODO(), &FileInsertInfo{Filepath: "bad.txt", FileBytes: []byte("content")})
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.Nil(t, instance.getFileInCloud(context.TODO(), "bad.txt"))
+	require.False(t, instance.localFileExist("bad.txt"))
+}
+
+func TestListManagedFoldersAndPurge(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, nil)
+	stray, err := instance.driveService.Files.Create(&drive.File{Name: "gdrive-stray", MimeType: "application/vnd.google-apps.folder"}).Do()
+	require.NoError(t, err)
+	other, err := instance.driveService.Files.Create(&drive.File{Name: "photos", MimeType: "application/vnd.google-apps.folder"}).Do()
+	require.NoError(t, err)
+
+	folders, err := instance.ListManagedFolders(context.TODO())
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range folders {
+		names = append(names, f.Name)
+	}
+	require.ElementsMatch(t, []string{"gdrive-fake", "gdrive-stray"}, names)
+
+	err = instance.Purge(context.TODO(), other.Id, false)
+	require.ErrorIs(t, err, ErrFolderNotOwned)
+	err = instance.Purge(context.TODO(), stray.Id, false)
+	require.NoError(t, err)
+	require.NotContains(t, fake.files, stray.Id)
+	require.Contains(t, fake.files, other.Id)
+}
+
+func TestStorageFull(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	fake.quota = 10
+	require.NoError(t, instance.StoreFile(context.TODO(), &FileInsertInfo{FileBytes: []byte("12345"), Filepath: "a.txt"}))
+	require.NoError(t, instance.StoreFile(context.TODO(), &FileInsertInfo{FileBytes: []byte("12345"), Filepath: "b.txt"}))
+
+	err := instance.StoreFile(context.TODO(), &FileInsertInfo{FileBytes: []byte("123"), Filepath: "c.txt"})
+	require.ErrorIs(t, err, ErrStorageFull)
+
+	instance.config.EvictRemoteOnFull = true
+	err = instance.StoreFile(context.TODO(), &FileInsertInfo{FileBytes: []byte("123"), Filepath: "c.txt"})
+	require.NoError(t, err)
+	require.Nil(t, instance.getFileInCloud(context.TODO(), "a.txt"))
+	require.NotNil(t, instance.getFileInCloud(context.TODO(), "b.txt"))
+	require.False(t, instance.localFileExist("a.txt"))
+	total, err := instance.dao.TotalSize(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, int64(8), total)
+}
+
+func TestStorageFullResumable(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	instance, fake := newFakeInstance(t, &Config{Clock: clock, ResumableThreshold: 1, EvictRemoteOnFull: true,
+		EvictionGracePeriod: time.Hour}, NewMemoryDao())
+	fake.quota = 10
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte("1234"), Filepath: "a.txt"}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte("1234"), Filepath: "b.txt"}))
+	clock.Add(2 * time.Hour)
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte("12"), Filepath: "c.txt"}))
+
+	// a.txt is in use and c.txt is in the grace period, only b.txt is evicted
+	unlock := instance.pathLocks.lock("a.txt")
+	defer unlock()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte("1234"), Filepath: "d.txt"}))
+	require.NotNil(t, instance.getFileInCloud(ctx, "a.txt"))
+	require.Nil(t, instance.getFileInCloud(ctx, "b.txt"))
+	require.NotNil(t, instance.getFileInCloud(ctx, "c.txt"))
+	require.True(t, instance.localFileExist("a.txt"))
+	require.False(t, instance.localFileExist("b.txt"))
+}
+
+func TestContentAddressedLocal(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{ContentAddressedLocal: true}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte("same"), Filepath: "a.txt"}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte("same"), Filepath: "dir/b.txt"}))
+
+	blobs, err := os.ReadDir(path.Join(instance.config.LocalFolderRoot, blobFolder))
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+	b, err := instance.readFile(ctx, "dir/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("same"), b)
+	untracked, err := instance.UntrackedLocal(ctx)
+	require.NoError(t, err)
+	require.Empty(t, untracked)
+
+	// the blob is kept while another path references it
+	require.NoError(t, instance.dao.Delete(ctx, "a.txt"))
+	require.NoError(t, instance.removeLocal(ctx, FileInfo{Filepath: "a.txt", ContentHash: instance.contentHash([]byte("same"))}))
+	_, err = os.Stat(instance.blobPath(instance.contentHash([]byte("same"))))
+	require.NoError(t, err)
+
+	require.NoError(t, instance.dao.Delete(ctx, "dir/b.txt"))
+	require.NoError(t, instance.removeLocal(ctx, FileInfo{Filepath: "dir/b.txt", ContentHash: instance.contentHash([]byte("same"))}))
+	_, err = os.Stat(instance.blobPath(instance.contentHash([]byte("same"))))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRetainOnly(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	for _, p := range []string{"a.txt", "b.txt", "dir/c.txt"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte(p), Filepath: p}))
+	}
+
+	// a file in use is skipped
+	unlock := instance.pathLocks.lock("b.txt")
+	require.NoError(t, instance.RetainOnly(ctx, []string{"a.txt"}))
+	unlock()
+	require.True(t, instance.localFileExist("a.txt"))
+	require.True(t, instance.localFileExist("b.txt"))
+	require.False(t, instance.localFileExist("dir/c.txt"))
+	_, err := instance.dao.Get(ctx, "dir/c.txt")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NotNil(t, instance.getFileInCloud(ctx, "dir/c.txt"))
+
+	require.NoError(t, instance.RetainOnlyEvictRemote(ctx, []string{"a.txt"}))
+	require.False(t, instance.localFileExist("b.txt"))
+	require.Nil(t, instance.getFileInCloud(ctx, "b.txt"))
+	require.NotNil(t, instance.getFileInCloud(ctx, "a.txt"))
+	count, err := instance.dao.Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestContentAddressedRebuild(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{ContentAddressedLocal: true}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte("same"), Filepath: "a.txt"}))
+
+	// the rebuilt rows still reference the blob
+	instance.dao = NewMemoryDao()
+	require.NoError(t, instance.RebuildDAOFromLocal(ctx))
+	fileInfo, err := instance.dao.Get(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, instance.contentHash([]byte("same")), fileInfo.ContentHash)
+}
+
+func TestCacheFolder(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{DownloadConcurrency: 2}, NewMemoryDao())
+	ctx := context.TODO()
+	for _, p := range []string{"docs/a.txt", "docs/sub/b.txt", "images/c.png"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{FileBytes: []byte(p), Filepath: p}))
+	}
+	// start from an empty cache
+	fresh, err := New(context.Background(), []byte(fakeCredential), &Config{LocalFolderRoot: t.TempDir(), RemoteFolderRoot: "fake"},
+		NewMemoryDao(), &oauth2.Token{AccessToken: "fake"}, instance.clientOptions...)
+	require.NoError(t, err)
+	require.NoError(t, fresh.Init())
+
+	require.NoError(t, fresh.CacheFolder(ctx, "docs/"))
+	require.True(t, fresh.localFileExist("docs/a.txt"))
+	require.True(t, fresh.localFileExist("docs/sub/b.txt"))
+	require.False(t, fresh.localFileExist("images/c.png"))
+	total, err := fresh.dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(len("docs/a.txt")+len("docs/sub/b.txt")), total)
+
+	// cached files are not downloaded again
+	downloads := fake.callCount("download")
+	require.NoError(t, fresh.CacheFolder(ctx, "docs/"))
+	require.Equal(t, downloads, fake.callCount("download"))
+
+	// a file stored while waiting for its lock is not overwritten by the download
+	unlock := fresh.pathLocks.lock("images/c.png")
+	done := make(chan error, 1)
+	go func() { done <- fresh.CacheFolder(ctx, "images/") }()
+	waitFor(t, func() bool { return lockWaiters(fresh, "images/c.png") == 2 })
+	require.NoError(t, os.MkdirAll(fresh.localFullPath("images"), 0755))
+	require.NoError(t, os.WriteFile(fresh.localFullPath("images/c.png"), []byte("newer"), 0644))
+	unlock()
+	require.NoError(t, <-done)
+	require.Equal(t, downloads, fake.callCount("download"))
+	b, err := os.ReadFile(fresh.localFullPath("images/c.png"))
+	require.NoError(t, err)
+	require.Equal(t, "newer", string(b))
+}
+
+type auditRecorder struct {
+	mut    sync.Mutex
+	events []AuditEvent
+}
+
+func (r *auditRecorder) Audit(event AuditEvent) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.events = append(r.events, event)
+}
+
+func TestAuditLogger(t *testing.T) {
+	recorder := &auditRecorder{}
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 15, AuditLogger: recorder}, NewMemoryDao())
+	ctx := WithActor(context.TODO(), "job-1")
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("0123456789")}))
+	instance.shouldRemove()
+	stray, err := instance.driveService.Files.Create(&drive.File{Name: "gdrive-stray", MimeType: "application/vnd.google-apps.folder"}).Do()
+	require.NoError(t, err)
+	require.NoError(t, instance.Purge(ctx, stray.Id, false))
+
+	require.Len(t, recorder.events, 2)
+	require.Equal(t, AuditEvict, recorder.events[0].Op)
+	require.Equal(t, "a.txt", recorder.events[0].Filepath)
+	require.NotEmpty(t, recorder.events[0].FileID)
+	require.Equal(t, int64(10), recorder.events[0].Size)
+	require.Equal(t, AuditPurge, recorder.events[1].Op)
+	require.Equal(t, stray.Id, recorder.events[1].FileID)
+	require.Equal(t, "job-1", recorder.events[1].Actor)
+}
+
+func TestDownloadParts(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{DownloadParts: 3}, NewMemoryDao())
+	ctx := context.TODO()
+	content := bytes.Repeat([]byte("0123456789"), 250*1024)
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.bin", FileBytes: content}))
+	require.NoError(t, os.Remove(instance.localFullPath("big.bin")))
+
+	downloads := fake.callCount("download")
+	b, err := instance.readFile(ctx, "big.bin")
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	require.Equal(t, downloads+3, fake.callCount("download"))
+
+	// a checksum mismatch is never committed to the cache
+	require.NoError(t, os.Remove(instance.localFullPath("big.bin")))
+	fake.mut.Lock()
+	for _, file := range fake.files {
+		if file.meta.Name == "big.bin" {
+			file.meta.Md5Checksum = "bogus"
+		}
+	}
+	fake.mut.Unlock()
+	fileInfo, err := instance.dao.Get(ctx, "big.bin")
+	require.NoError(t, err)
+	fileInfo.Md5 = "bogus"
+	require.NoError(t, instance.dao.InsertOrUpdate(ctx, fileInfo))
+	_, err = instance.readFile(ctx, "big.bin")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.False(t, instance.localFileExist("big.bin"))
+}
+
+func TestConflictVersion(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{ConflictMode: ConflictVersion}, NewMemoryDao())
+	ctx := context.TODO()
+	stored := []string{}
+	for i := 0; i < 3; i++ {
+		info := &FileInsertInfo{Filepath: "dir/report.txt", FileBytes: []byte(fmt.Sprint(i))}
+		require.NoError(t, instance.StoreFile(ctx, info))
+		stored = append(stored, info.StoredPath)
+	}
+	require.Equal(t, []string{"dir/report.txt", "dir/report (1).txt", "dir/report (2).txt"}, stored)
+	files, err := instance.allFiles(ctx)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	require.Equal(t, "dir/report (2).txt", files[2].Filepath)
+
+	// a slot only taken on google drive is skipped as well
+	require.NoError(t, os.Remove(instance.localFullPath("dir/report (1).txt")))
+	info := &FileInsertInfo{Filepath: "dir/report.txt", FileBytes: []byte("3")}
+	require.NoError(t, instance.StoreFile(ctx, info))
+	require.Equal(t, "dir/report (3).txt", info.StoredPath)
+
+	instance.config.VersionSuffixFormat = "%s_v%d%s"
+	info = &FileInsertInfo{Filepath: "dir/report.txt", FileBytes: []byte("4")}
+	require.NoError(t, instance.StoreFile(ctx, info))
+	require.Equal(t, "dir/report_v1.txt", info.StoredPath)
+}
+
+func TestEvictionSkipsDownloading(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{TotalMaxSize: 15}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("0123456789")}))
+	// a.txt is the oldest dao row but its cache file is being fetched again
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+
+	fake.downloadStarted = make(chan struct{}, 1)
+	fake.downloadGate = make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := instance.readFile(ctx, "a.txt")
+		done <- err
+	}()
+	<-fake.downloadStarted
+	instance.shouldRemove()
+	close(fake.downloadGate)
+	require.NoError(t, <-done)
+
+	require.True(t, instance.localFileExist("a.txt"))
+	require.False(t, instance.localFileExist("b.txt"))
+}
+
+func TestEmptyFile(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "empty.txt", FileBytes: []byte{}}))
+	require.True(t, instance.localFileExist("empty.txt"))
+	driveFile := instance.getFileInCloud(ctx, "empty.txt")
+	require.NotNil(t, driveFile)
+	require.Equal(t, int64(0), driveFile.Size)
+
+	// an empty file is still a cache hit and still downloadable
+	b, err := instance.readFile(ctx, "empty.txt")
+	require.NoError(t, err)
+	require.Empty(t, b)
+	require.NoError(t, os.Remove(instance.localFullPath("empty.txt")))
+	downloads := fake.callCount("download")
+	b, err = instance.readFile(ctx, "empty.txt")
+	require.NoError(t, err)
+	require.Empty(t, b)
+	require.Equal(t, downloads+1, fake.callCount("download"))
+	require.True(t, instance.localFileExist("empty.txt"))
+
+	err = instance.StoreFile(ctx, &FileInsertInfo{Filepath: "empty.txt", FileBytes: []byte{}})
+	require.ErrorIs(t, err, ErrFileExist)
+
+	instance.config.RejectEmpty = true
+	err = instance.StoreFile(ctx, &FileInsertInfo{Filepath: "other.txt", FileBytes: nil})
+	require.ErrorIs(t, err, ErrEmptyFile)
+	require.Nil(t, instance.getFileInCloud(ctx, "other.txt"))
+	require.False(t, instance.localFileExist("other.txt"))
+}
+
+func TestRemoteIndex(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")}))
+	require.NoError(t, instance.RefreshRemoteIndex(ctx))
+
+	lists := fake.callCount("list")
+	require.NotNil(t, instance.getFileInCloud(ctx, "a.txt"))
+	require.Nil(t, instance.getFileInCloud(ctx, "missing.txt"))
+	require.Equal(t, lists, fake.callCount("list"))
+
+	// files stored by this instance are looked up again
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("b")}))
+	require.NotNil(t, instance.getFileInCloud(ctx, "b.txt"))
+	lists = fake.callCount("list")
+	require.NotNil(t, instance.getFileInCloud(ctx, "b.txt"))
+	require.Equal(t, lists, fake.callCount("list"))
+
+	instance.InvalidateRemoteIndex()
+	require.Nil(t, instance.getFileInCloud(ctx, "missing.txt"))
+	require.Equal(t, lists+1, fake.callCount("list"))
+}
+
+type fakeClock struct {
+	mut sync.Mutex
+	t   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	// the default memory dao keeps the LastAccess of the injected clock
+	instance, _ := newFakeInstance(t, &Config{Clock: clock, TotalMaxSize: 15, EvictionGracePeriod: time.Hour},
+		NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789"),
+		Replace: true}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("0123456789")}))
+	files, err := instance.allFiles(ctx)
+	require.NoError(t, err)
+	require.Equal(t, clock.Now(), files[0].LastAccess)
+	require.Equal(t, clock.Now(), files[1].LastAccess)
+
+	// both files are within the grace period of the fake clock
+	instance.shouldRemove()
+	require.True(t, instance.localFileExist("a.txt"))
+	clock.Add(2 * time.Hour)
+	instance.shouldRemove()
+	require.False(t, instance.localFileExist("a.txt"))
+
+	skew, err := instance.clockSkew(ctx)
+	require.NoError(t, err)
+	require.Zero(t, skew)
+	clock.Add(-3 * time.Hour)
+	skew, err = instance.clockSkew(ctx)
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, skew)
+}
+
+func TestExportMap(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{ExportMap: map[string]string{"application/vnd.google-apps.document": "application/pdf"}}, dao)
+	ctx := context.TODO()
+	_, err := instance.driveService.Files.Create(&drive.File{Name: "report", MimeType: "application/vnd.google-apps.document",
+		Parents: []string{instance.parentFolderID}}).Media(bytes.NewReader([]byte("hello"))).Do()
+	require.NoError(t, err)
+
+	b, err := instance.readFile(ctx, "report")
+	require.NoError(t, err)
+	require.Equal(t, "application/pdf:hello", string(b))
+	require.Equal(t, 1, fake.callCount("export"))
+	require.Equal(t, 0, fake.callCount("download"))
+	files, err := instance.allFiles(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "application/pdf", files[0].MimeType)
+	require.Equal(t, "application/vnd.google-apps.document", files[0].SourceMimeType)
+
+	// the exported form is served from the cache
+	b, err = instance.readFile(ctx, "report")
+	require.NoError(t, err)
+	require.Equal(t, "application/pdf:hello", string(b))
+	require.Equal(t, 1, fake.callCount("export"))
+}
+
+func TestReadFile(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "dir/a.txt", FileBytes: []byte("content")}))
+
+	b, err := instance.ReadFile(ctx, "dir/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("content"), b)
+	require.Equal(t, 0, fake.callCount("download"))
+
+	require.NoError(t, os.Remove(instance.localFullPath("dir/a.txt")))
+	b, err = instance.ReadFile(ctx, "dir/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("content"), b)
+	require.Equal(t, 1, fake.callCount("download"))
+	require.True(t, instance.localFileExist("dir/a.txt"))
+
+	_, err = instance.ReadFile(ctx, "missing.txt")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, os.Remove(instance.localFullPath("dir/a.txt")))
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = instance.ReadFile(canceled, "dir/a.txt")
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestStoreFileStream(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	content := bytes.Repeat([]byte("stream"), 1000)
+	// hide the Seek method of the bytes reader
+	err := instance.StoreFileStream(ctx, "dir/stream.bin", io.MultiReader(bytes.NewReader(content)), -1, false)
+	require.NoError(t, err)
+	b, err := os.ReadFile(instance.localFullPath("dir/stream.bin"))
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	total, err := dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), total)
+	require.Equal(t, int64(len(content)), instance.getFileInCloud(ctx, "dir/stream.bin").Size)
+
+	err = instance.StoreFileStream(ctx, "dir/stream.bin", bytes.NewReader(content), -1, false)
+	require.ErrorIs(t, err, ErrFileExist)
+
+	// a broken stream leaves neither the new file nor a temporary file behind
+	err = instance.StoreFileStream(ctx, "broken.bin", &failingReader{r: bytes.NewReader(content)}, -1, false)
+	require.Error(t, err)
+	require.False(t, instance.localFileExist("broken.bin"))
+	require.False(t, instance.localFileExist("broken.bin.tmp"))
+
+	err = instance.StoreFileStream(ctx, "short.bin", bytes.NewReader(content), int64(len(content))+1, false)
+	require.Error(t, err)
+	require.False(t, instance.localFileExist("short.bin"))
+}
+
+func TestStoreFileStreamRules(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)}
+	instance, _ := newFakeInstance(t, &Config{Clock: clock, DatePartition: "2006/01/02", RejectEmpty: true,
+		ConflictMode: ConflictVersion}, NewMemoryDao())
+	ctx := context.TODO()
+
+	err := instance.StoreFileStream(ctx, "empty.txt", io.MultiReader(), -1, false)
+	require.ErrorIs(t, err, ErrEmptyFile)
+	require.Nil(t, instance.getFileInCloud(ctx, "2030/01/02/empty.txt"))
+
+	require.NoError(t, instance.StoreFileStream(ctx, "a.txt", strings.NewReader("a"), 1, false))
+	require.NoError(t, instance.StoreFileStream(ctx, "a.txt", strings.NewReader("b"), 1, false))
+	b, err := os.ReadFile(instance.localFullPath("2030/01/02/a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), b)
+	b, err = os.ReadFile(instance.localFullPath("2030/01/02/a (1).txt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), b)
+
+	// the store waits for the path lock held by another operation
+	unlock := instance.pathLocks.lock("2030/01/02/c.txt")
+	done := make(chan error, 1)
+	go func() {
+		done <- instance.StoreFileStream(ctx, "c.txt", strings.NewReader("c"), 1, false)
+	}()
+	waitFor(t, func() bool { return lockWaiters(instance, "2030/01/02/c.txt") == 2 })
+	require.False(t, instance.localFileExist("2030/01/02/c.txt"))
+	unlock()
+	require.NoError(t, <-done)
+	require.True(t, instance.localFileExist("2030/01/02/c.txt"))
+}
+
+func TestReadFileStream(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.bin", FileBytes: content}))
+
+	r, err := instance.ReadFileStream(ctx, "a.bin")
+	require.NoError(t, err)
+	require.IsType(t, &os.File{}, r)
+	require.NoError(t, r.Close())
+
+	// a partially read stream is not cached
+	require.NoError(t, os.Remove(instance.localFullPath("a.bin")))
+	r, err = instance.ReadFileStream(ctx, "a.bin")
+	require.NoError(t, err)
+	_, err = io.ReadFull(r, make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.False(t, instance.localFileExist("a.bin"))
+	require.False(t, instance.localFileExist("a.bin.tmp"))
+
+	r, err = instance.ReadFileStream(ctx, "a.bin")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	require.False(t, instance.localFileExist("a.bin"))
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close())
+	require.Equal(t, 2, fake.callCount("download"))
+	cached, err := os.ReadFile(instance.localFullPath("a.bin"))
+	require.NoError(t, err)
+	require.Equal(t, content, cached)
+	require.False(t, instance.isDownloading("a.bin"))
+
+	_, err = instance.ReadFileStream(ctx, "missing.bin")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+// cancelReader cancels the context as soon as the upload starts reading
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return c.r.Read(p)
+}
+
+func TestUploadHonorsContext(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := instance.StoreFileStream(ctx, "a.bin", &cancelReader{r: bytes.NewReader([]byte("content")), cancel: cancel}, -1, false)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Nil(t, instance.getFileInCloud(context.TODO(), "a.bin"))
+	require.False(t, instance.localFileExist("a.bin"))
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = instance.StoreFile(canceled, &FileInsertInfo{Filepath: "b.bin", FileBytes: []byte("content")})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Nil(t, instance.getFileInCloud(context.TODO(), "b.bin"))
+}
+
+func TestEscapeDriveQuery(t *testing.T) {
+	require.Equal(t, `o\'brien.txt`, escapeDriveQuery("o'brien.txt"))
+	require.Equal(t, `back\\slash\\\'`, escapeDriveQuery(`back\slash\'`))
+
+	instance, _ := newFakeInstance(t, &Config{RemoteFolderRoot: "it's"}, NewMemoryDao())
+	ctx := context.TODO()
+	for _, p := range []string{"o'brien.txt", `dir\name's.txt`, "plain.txt"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte(p)}))
+		require.NotNil(t, instance.getFileInCloud(ctx, p))
+		require.NoError(t, os.Remove(instance.localFullPath(p)))
+		b, err := instance.ReadFile(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, []byte(p), b)
+	}
+	err := instance.StoreFile(ctx, &FileInsertInfo{Filepath: "o'brien.txt", FileBytes: []byte("again")})
+	require.ErrorIs(t, err, ErrFileExist)
+}
+
+func TestStoreFileTwice(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("first")}))
+	lists := fake.callCount("list")
+	err := instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("second")})
+	require.ErrorIs(t, err, ErrFileExist)
+	// the local copy is enough to reject the store
+	require.Equal(t, lists, fake.callCount("list"))
+
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("second"), Replace: true}))
+	b, err := instance.ReadFile(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), b)
+}
+
+func TestUploadAllConcurrency(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{UploadConcurrency: 1}, dao)
+	ctx := context.TODO()
+	paths := []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "d.txt"}
+	for _, p := range paths {
+		require.NoError(t, instance.storeFileToLocal(ctx, p, []byte(p)))
+	}
+	require.NoError(t, instance.UploadAll(ctx))
+	for _, p := range paths {
+		require.NotNil(t, instance.getFileInCloud(ctx, p), p)
+	}
+	files, err := dao.QueryOldest(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, files, len(paths))
+}
+
+func TestUploadAllErrors(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.storeFileToLocal(ctx, "a.txt", []byte("a")))
+	require.NoError(t, instance.storeFileToLocal(ctx, "dir/b.txt", []byte("b")))
+	// a dangling link can not be opened
+	require.NoError(t, os.Symlink(instance.localFullPath("gone.txt"), instance.localFullPath("broken.txt")))
+
+	err := instance.UploadAll(ctx)
+	require.Error(t, err)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Contains(t, err.Error(), "broken.txt")
+	require.NotNil(t, instance.getFileInCloud(ctx, "a.txt"))
+	require.NotNil(t, instance.getFileInCloud(ctx, "dir/b.txt"))
+	require.Nil(t, instance.getFileInCloud(ctx, "broken.txt"))
+	total, err := dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), total)
+}
+
+func TestUploadAllFailedUpload(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.storeFileToLocal(ctx, "a.txt", []byte("a")))
+	require.NoError(t, instance.storeFileToLocal(ctx, "dir/rejected.txt", []byte("rejected")))
+	fake.rejectNames = []string{instance.convertToGDrive("dir/rejected.txt")}
+
+	// the failed upload has no result, it must not reach the dao
+	err := instance.UploadAll(ctx)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dir/rejected.txt")
+	files, err := dao.QueryOldest(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "a.txt", files[0].Filepath)
+}
+
+func TestDeleteFile(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "dir/a.txt", FileBytes: []byte("a")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("b")}))
+
+	require.NoError(t, instance.DeleteFile(ctx, "dir/a.txt"))
+	require.False(t, instance.localFileExist("dir/a.txt"))
+	require.Nil(t, instance.getFileInCloud(ctx, "dir/a.txt"))
+	files, err := dao.QueryOldest(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "b.txt", files[0].Filepath)
+
+	// a file only left on google drive is deleted as well
+	require.NoError(t, os.Remove(instance.localFullPath("b.txt")))
+	require.NoError(t, instance.DeleteFile(ctx, "b.txt"))
+	require.Nil(t, instance.getFileInCloud(ctx, "b.txt"))
+
+	require.ErrorIs(t, instance.DeleteFile(ctx, "missing.txt"), ErrNotFound)
+}
+
+func TestExists(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "both.txt", FileBytes: []byte("both")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "remote.txt", FileBytes: []byte("remote")}))
+	require.NoError(t, os.Remove(instance.localFullPath("remote.txt")))
+	require.NoError(t, instance.storeFileToLocal(ctx, "local.txt", []byte("local")))
+
+	for _, c := range []struct {
+		path          string
+		local, remote bool
+	}{
+		{"both.txt", true, true},
+		{"remote.txt", false, true},
+		{"local.txt", true, false},
+		{"missing.txt", false, false},
+	} {
+		local, remote, err := instance.Exists(ctx, c.path)
+		require.NoError(t, err)
+		require.Equal(t, c.local, local, c.path)
+		require.Equal(t, c.remote, remote, c.path)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	stored := []string{}
+	for i := 0; i < 5; i++ {
+		p := fmt.Sprintf("dir/file%d.txt", i)
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte(p), Description: "desc"}))
+		stored = append(stored, p)
+	}
+
+	listed := []string{}
+	pageToken := ""
+	pages := 0
+	for {
+		files, next, err := instance.ListFiles(ctx, pageToken, 3)
+		require.NoError(t, err)
+		pages++
+		for _, f := range files {
+			require.Equal(t, "desc", f.Description)
+			require.Equal(t, int64(len(f.Filepath)), f.Size)
+			listed = append(listed, f.Filepath)
+		}
+		if next == "" {
+			break
+		}
+		pageToken = next
+	}
+	require.Equal(t, 2, pages)
+	require.ElementsMatch(t, stored, listed)
+
+	// out of range page sizes are not sent to google drive
+	for _, pageSize := range []int{0, -1, 5000} {
+		files, next, err := instance.ListFiles(ctx, "", pageSize)
+		require.NoError(t, err)
+		require.Len(t, files, 5)
+		require.Empty(t, next)
+	}
+}
+
+func TestUseNativeFolders(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{UseNativeFolders: true}, NewMemoryDao())
+	ctx := context.TODO()
+	for _, p := range []string{"folder/filetwo.txt", "folder/sub/three.txt", "folder/a#b.txt", "root.txt"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte(p)}))
+	}
+
+	byName := map[string]drive.File{}
+	folders := 0
+	for _, f := range fake.files {
+		byName[f.meta.Name] = f.meta
+		if f.meta.MimeType == "application/vnd.google-apps.folder" {
+			folders++
+		}
+	}
+	// the parent folder, folder and folder/sub
+	require.Equal(t, 3, folders)
+	require.Equal(t, []string{instance.parentFolderID}, byName["folder"].Parents)
+	require.Equal(t, []string{byName["folder"].Id}, byName["sub"].Parents)
+	require.Equal(t, []string{byName["folder"].Id}, byName["filetwo.txt"].Parents)
+	require.Equal(t, []string{byName["sub"].Id}, byName["three.txt"].Parents)
+	require.Equal(t, []string{instance.parentFolderID}, byName["root.txt"].Parents)
+
+	require.NoError(t, os.Remove(instance.localFullPath("folder/sub/three.txt")))
+	b, err := instance.ReadFile(ctx, "folder/sub/three.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("folder/sub/three.txt"), b)
+
+	// lookups never create folders
+	creates := fake.callCount("create")
+	local, remote, err := instance.Exists(ctx, "other/missing.txt")
+	require.NoError(t, err)
+	require.False(t, local)
+	require.False(t, remote)
+	require.Equal(t, creates, fake.callCount("create"))
+
+	fresh, err := New(context.Background(), []byte(fakeCredential), &Config{LocalFolderRoot: t.TempDir(), RemoteFolderRoot: "fake",
+		UseNativeFolders: true}, NewMemoryDao(), &oauth2.Token{AccessToken: "fake"}, instance.clientOptions...)
+	require.NoError(t, err)
+	require.NoError(t, fresh.Init())
+	require.NoError(t, fresh.CacheFolder(ctx, "folder/"))
+	require.True(t, fresh.localFileExist("folder/filetwo.txt"))
+	require.True(t, fresh.localFileExist("folder/sub/three.txt"))
+	require.True(t, fresh.localFileExist("folder/a#b.txt"))
+	require.False(t, fresh.localFileExist("root.txt"))
+}
+
+func TestConvertGDriveRoundTrip(t *testing.T) {
+	instance := &GDrive{}
+	for _, p := range []string{
+		"plain.txt",
+		"dir/sub/file.txt",
+		"a#b.txt",
+		"dir/a#b/c.txt",
+		"100%/50%25.txt",
+		"with space/and more.txt",
+		"ユニコード/ファイル.txt",
+		"#/%/#%23",
+	} {
+		name := instance.convertToGDrive(p)
+		require.NotContains(t, name, "/")
+		require.Equal(t, p, instance.convertFromGDrive(name), p)
+	}
+	// paths without # or % keep the names of existing caches
+	require.Equal(t, "dir#file.txt", instance.convertToGDrive("dir/file.txt"))
+	require.NotEqual(t, instance.convertToGDrive("a#b.txt"), instance.convertToGDrive("a/b.txt"))
+}
+
+func TestLegacyRemoteName(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	// stored before # was encoded
+	legacy, err := instance.driveService.Files.Create(&drive.File{Name: "dir#a#b.txt",
+		Parents: []string{instance.parentFolderID}}).Media(bytes.NewReader([]byte("old"))).Do()
+	require.NoError(t, err)
+
+	b, err := instance.readFile(ctx, "dir/a#b.txt")
+	require.NoError(t, err)
+	require.Equal(t, "old", string(b))
+
+	// the legacy file is replaced instead of stored again under the encoded name
+	instance.forgetRemote("dir/a#b.txt")
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "dir/a#b.txt", FileBytes: []byte("new"), Replace: true}))
+	driveFile := instance.queryRemote(ctx, "dir/a#b.txt")
+	require.NotNil(t, driveFile)
+	require.Equal(t, legacy.Id, driveFile.Id)
+	require.Equal(t, "new", string(fake.files[legacy.Id].content))
+}
+
+type sequenceTokenSource struct {
+	mut    sync.Mutex
+	tokens []*oauth2.Token
+}
+
+func (s *sequenceTokenSource) Token() (*oauth2.Token, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	token := s.tokens[0]
+	if len(s.tokens) > 1 {
+		s.tokens = s.tokens[1:]
+	}
+	return token, nil
+}
+
+func TestOnTokenRefresh(t *testing.T) {
+	initial := &oauth2.Token{AccessToken: "first", RefreshToken: "refresh"}
+	refreshed := &oauth2.Token{AccessToken: "second", RefreshToken: "refresh"}
+	source := &sequenceTokenSource{tokens: []*oauth2.Token{initial, initial, refreshed, refreshed}}
+	persisted := []string{}
+	notifier := newRefreshNotifier(source, initial, func(token *oauth2.Token) {
+		persisted = append(persisted, token.AccessToken)
+	})
+	for i := 0; i < 4; i++ {
+		_, err := notifier.Token()
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"second"}, persisted)
+
+	// the automatic refresh of the drive client goes through the callback as well
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"renewed","token_type":"Bearer","refresh_token":"refresh","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+	fake := newFakeDrive()
+	driveSrv := httptest.NewServer(fake)
+	defer driveSrv.Close()
+	credential := strings.ReplaceAll(fakeCredential, "http://localhost/token", tokenSrv.URL)
+	persisted = []string{}
+	instance, err := New(context.Background(), []byte(credential), &Config{LocalFolderRoot: t.TempDir(), RemoteFolderRoot: "fake",
+		OnTokenRefresh: func(token *oauth2.Token) { persisted = append(persisted, token.AccessToken) }},
+		nil, &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)},
+		option.WithEndpoint(driveSrv.URL+"/drive/v3/"))
+	require.NoError(t, err)
+	require.NoError(t, instance.Init())
+	require.Equal(t, []string{"renewed"}, persisted)
+}
+
+func TestEvictionInterval(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 25, EvictionInterval: 20 * time.Millisecond, EvictionBatchSize: 1},
+		NewMemoryDao())
+	ctx := context.TODO()
+	for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte("0123456789")}))
+	}
+	go instance.Start()
+	require.Eventually(t, func() bool {
+		total, err := instance.dao.TotalSize(ctx)
+		return err == nil && total <= 25
+	}, time.Second, 10*time.Millisecond)
+	require.True(t, instance.localFileExist("c.txt"))
+}
+
+func TestLRUPolicy(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	now := time.Now()
+	for i, p := range []string{"c.txt", "b.txt", "a.txt"} {
+		require.NoError(t, dao.InsertOrUpdate(ctx, &FileInfo{Filepath: p, Size: 10}))
+		require.NoError(t, dao.Touch(ctx, p, now.Add(time.Duration(i)*time.Minute)))
+	}
+	policy := &LRUPolicy{BatchSize: 1}
+	list, err := policy.Select(ctx, dao, 15)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, "c.txt", list[0].Filepath)
+	require.Equal(t, "b.txt", list[1].Filepath)
+
+	list, err = policy.Select(ctx, dao, 100)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+
+	// the oldest file outlives newer ones of a lower priority
+	require.NoError(t, dao.SetPriority(ctx, "c.txt", 1))
+	list, err = policy.Select(ctx, dao, 15)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, "b.txt", list[0].Filepath)
+	require.Equal(t, "a.txt", list[1].Filepath)
+
+	// files sharing a last access are all reached across batches
+	for _, p := range []string{"d.txt", "e.txt", "f.txt"} {
+		require.NoError(t, dao.InsertOrUpdate(ctx, &FileInfo{Filepath: p, Size: 10, LastAccess: now.Add(-time.Hour)}))
+	}
+	list, err = policy.Select(ctx, dao, 45)
+	require.NoError(t, err)
+	require.Len(t, list, 5)
+	require.Equal(t, "d.txt", list[0].Filepath)
+	require.Equal(t, "f.txt", list[2].Filepath)
+
+	list, err = policy.SelectCount(ctx, dao, 4)
+	require.NoError(t, err)
+	require.Len(t, list, 4)
+	require.Equal(t, "d.txt", list[0].Filepath)
+	require.Equal(t, "b.txt", list[3].Filepath)
+}
+
+// largestFirst evicts the biggest files first
+type largestFirst struct{}
+
+func (largestFirst) Select(ctx context.Context, dao Dao, bytesToFree int64) ([]FileInfo, error) {
+	list, err := dao.QueryOldest(ctx, 1000)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Size > list[j].Size })
+	return list, nil
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 25, EvictionPolicy: largestFirst{}}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "small.txt", FileBytes: []byte("01234")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.txt", FileBytes: []byte("0123456789abcdef")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "mid.txt", FileBytes: []byte("0123456789")}))
+	instance.shouldRemove()
+	require.True(t, instance.localFileExist("small.txt"))
+	require.True(t, instance.localFileExist("mid.txt"))
+	require.False(t, instance.localFileExist("big.txt"))
+
+	// the file count limit follows the policy as well
+	instance.config.TotalMaxSize = 1 << 30
+	instance.config.MaxFileCount = 1
+	instance.shouldRemove()
+	require.True(t, instance.localFileExist("small.txt"))
+	require.False(t, instance.localFileExist("mid.txt"))
+}
+
+// pinnedPolicy always selects one more pinned file than before, so nothing it selects can be evicted
+type pinnedPolicy struct {
+	calls int
+}
+
+func (p *pinnedPolicy) Select(ctx context.Context, dao Dao, bytesToFree int64) ([]FileInfo, error) {
+	p.calls++
+	list := make([]FileInfo, p.calls)
+	for i := range list {
+		list[i] = FileInfo{Filepath: "pinned.txt", Size: 10}
+	}
+	return list, nil
+}
+
+func TestEvictionRoundsBounded(t *testing.T) {
+	policy := &pinnedPolicy{}
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 5, EvictionPolicy: policy}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "pinned.txt", FileBytes: []byte("0123456789")}))
+	instance.pinned["pinned.txt"] = struct{}{}
+	require.True(t, instance.evictOnce(ctx))
+	require.Equal(t, maxEvictionRounds, policy.calls)
+}
+
+// truncatingTransport drops the last byte of every download
+type truncatingTransport struct {
+	base http.RoundTripper
+}
+
+func (t truncatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.URL.Query().Get("alt") != "media" {
+		return resp, err
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	b = b[:len(b)-1]
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	return resp, nil
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")}))
+	files, err := dao.QueryOldest(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, "781e5e245d69b566979b86e28d23f2c7", files[0].Md5)
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+
+	service, err := drive.NewService(ctx, option.WithEndpoint(instance.driveService.BasePath),
+		option.WithHTTPClient(&http.Client{Transport: truncatingTransport{base: http.DefaultTransport}}))
+	require.NoError(t, err)
+	instance.driveService = service
+
+	err = instance.TouchFile(ctx, "a.txt")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.False(t, instance.localFileExist("a.txt"))
+
+	r, err := instance.ReadFileStream(ctx, "a.txt")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.Close(), ErrChecksumMismatch)
+	require.False(t, instance.localFileExist("a.txt"))
+}
+
+func TestUploadAllSkipsIdentical(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.storeFileToLocal(ctx, "a.txt", []byte("a")))
+	require.NoError(t, instance.storeFileToLocal(ctx, "dir/b.txt", []byte("b")))
+
+	result, err := instance.UploadAllWithResult(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.txt", "dir/b.txt"}, result.Uploaded)
+	require.Empty(t, result.Skipped)
+	uploads := fake.callCount("create") + fake.callCount("update") + fake.callCount("session")
+
+	result, err = instance.UploadAllWithResult(ctx)
+	require.NoError(t, err)
+	require.Empty(t, result.Uploaded)
+	require.Equal(t, []string{"a.txt", "dir/b.txt"}, result.Skipped)
+	require.Equal(t, uploads, fake.callCount("create")+fake.callCount("update")+fake.callCount("session"))
+
+	// the priority of the dao row is kept
+	require.NoError(t, instance.SetPriority(ctx, "a.txt", 7))
+	_, err = instance.UploadAllWithResult(ctx)
+	require.NoError(t, err)
+	stored, err := instance.dao.Get(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, 7, stored.Priority)
+
+	// a changed file is a conflict, google drive keeps its content
+	require.NoError(t, instance.storeFileToLocal(ctx, "a.txt", []byte("c")))
+	require.NoError(t, instance.storeFileToLocal(ctx, "dir/b.txt", []byte("changed")))
+	result, err = instance.UploadAllWithResult(ctx)
+	require.NoError(t, err)
+	require.Empty(t, result.Uploaded)
+	require.Equal(t, []string{"a.txt", "dir/b.txt"}, result.Conflicts)
+	assertRemote := func(p string, content []byte) {
+		driveFile := instance.getFileInCloud(ctx, p)
+		require.NotNil(t, driveFile)
+		fake.mut.Lock()
+		defer fake.mut.Unlock()
+		require.Equal(t, content, fake.files[driveFile.Id].content)
+		stored, err := instance.dao.Get(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, driveFile.Md5Checksum, stored.Md5)
+		sum := md5.Sum(content)
+		require.Equal(t, hex.EncodeToString(sum[:]), stored.Md5)
+	}
+	assertRemote("a.txt", []byte("a"))
+	assertRemote("dir/b.txt", []byte("b"))
+	require.Equal(t, uploads, fake.callCount("create")+fake.callCount("update")+fake.callCount("session"))
+
+	// an exported google doc is never uploaded over the native file
+	require.NoError(t, instance.storeFileToLocal(ctx, "doc.pdf", []byte("exported")))
+	require.NoError(t, instance.dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "doc.pdf", MimeType: "application/pdf",
+		SourceMimeType: "application/vnd.google-apps.document"}))
+	result, err = instance.UploadAllWithResult(ctx)
+	require.NoError(t, err)
+	require.Empty(t, result.Uploaded)
+	require.Contains(t, result.Skipped, "doc.pdf")
+	require.Nil(t, instance.getFileInCloud(ctx, "doc.pdf"))
+	// the parent folder and both files
+	require.Len(t, fake.files, 3)
+}
+
+func TestGetLoginURLWithState(t *testing.T) {
+	instance, err := New(context.Background(), []byte(fakeCredential), &Config{}, nil, nil)
+	require.NoError(t, err)
+	u, err := url.Parse(instance.GetLoginURLWithState("csrf-123", oauth2.ApprovalForce))
+	require.NoError(t, err)
+	require.Equal(t, "csrf-123", u.Query().Get("state"))
+	require.Equal(t, "offline", u.Query().Get("access_type"))
+	require.Equal(t, "consent", u.Query().Get("prompt"))
+	require.Equal(t, drive.DriveFileScope, u.Query().Get("scope"))
+
+	instance, err = New(context.Background(), []byte(fakeCredential), &Config{Scopes: []string{drive.DriveScope}}, nil, nil)
+	require.NoError(t, err)
+	u, err = url.Parse(instance.GetLoginURL())
+	require.NoError(t, err)
+	require.Equal(t, "state-token", u.Query().Get("state"))
+	require.Equal(t, drive.DriveScope, u.Query().Get("scope"))
+}
+
+func TestExchangeOauthCodeWithState(t *testing.T) {
+	exchanged := 0
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanged++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+	credential := strings.ReplaceAll(fakeCredential, "http://localhost/token", tokenSrv.URL)
+	clock := &fakeClock{t: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	instance, err := New(context.Background(), []byte(credential), &Config{Clock: clock}, nil, nil)
+	require.NoError(t, err)
+	ctx := context.TODO()
+
+	_, err = instance.ExchangeOauthCodeWithState(ctx, "forged", "code")
+	require.ErrorIs(t, err, ErrStateMismatch)
+	require.Equal(t, 0, exchanged)
+
+	instance.GetLoginURLWithState("issued")
+	token, err := instance.ExchangeOauthCodeWithState(ctx, "issued", "code")
+	require.NoError(t, err)
+	require.Equal(t, "access", token.AccessToken)
+	require.Equal(t, 1, exchanged)
+
+	// a state is only valid once
+	_, err = instance.ExchangeOauthCodeWithState(ctx, "issued", "code")
+	require.ErrorIs(t, err, ErrStateMismatch)
+
+	// expired states are rejected and pruned by the next login url
+	instance.GetLoginURLWithState("expired")
+	clock.Add(loginStateTTL)
+	_, err = instance.ExchangeOauthCodeWithState(ctx, "expired", "code")
+	require.ErrorIs(t, err, ErrStateMismatch)
+	instance.GetLoginURLWithState("abandoned")
+	clock.Add(loginStateTTL)
+	instance.GetLoginURLWithState("latest")
+	require.Len(t, instance.loginStates, 1)
+	require.Equal(t, 1, exchanged)
+}
+
+func TestExchangeOauthCodeOptions(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+	credential := strings.ReplaceAll(fakeCredential, "http://localhost/token", tokenSrv.URL)
+	instance, err := New(context.Background(), []byte(credential), &Config{}, nil, nil, option.WithUserAgent("app"))
+	require.NoError(t, err)
+
+	// concurrent exchanges do not share or grow the options of New
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := instance.ExchangeOauthCode("code", option.WithUserAgent("exchange"))
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Len(t, instance.clientOptions, 1)
+	require.Len(t, instance.exchangeOpts, 1)
+
+	// a refreshed token keeps the options of the exchange
+	_, err = instance.RefreshToken(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, instance.exchangeOpts, 1)
+}
+
+func TestSamePathConcurrency(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("initial")}))
+
+	errs := make(chan error, 40)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			content := []byte(strings.Repeat("x", i+1))
+			errs <- instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: content, Replace: true})
+		}(i)
+		go func() {
+			defer wg.Done()
+			// the file may be replaced at the same time, a touch must still find it
+			errs <- instance.TouchFile(ctx, "a.txt")
+			os.Remove(instance.localFullPath("a.txt"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, instance.TouchFile(ctx, "a.txt"))
+	local, err := os.ReadFile(instance.localFullPath("a.txt"))
+	require.NoError(t, err)
+	driveFile := instance.getFileInCloud(ctx, "a.txt")
+	require.NotNil(t, driveFile)
+	fake.mut.Lock()
+	remote := fake.files[driveFile.Id].content
+	fake.mut.Unlock()
+	require.Equal(t, string(remote), string(local))
+	files, err := dao.QueryOldest(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, int64(len(local)), files[0].Size)
+}
+
+func TestTouchFileSharedDownload(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")}))
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+
+	fake.downloadStarted = make(chan struct{}, 1)
+	fake.downloadGate = make(chan struct{})
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- instance.TouchFile(ctx, "a.txt")
+		}()
+	}
+	<-fake.downloadStarted
+	close(fake.downloadGate)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.Equal(t, 1, fake.callCount("download"))
+	require.True(t, instance.localFileExist("a.txt"))
+
+	// every waiter gets the error of the shared call
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- instance.TouchFile(ctx, "missing.txt")
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.ErrorIs(t, <-errs, ErrNotFound)
+	}
+}
+
+func TestEvictionSinglePass(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{EvictionBatchSize: 1}, dao)
+	ctx := context.TODO()
+	for i := 0; i < 30; i++ {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: fmt.Sprintf("small%d.txt", i), FileBytes: []byte("0123456789")}))
+	}
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.txt", FileBytes: bytes.Repeat([]byte("x"), 1000)}))
+	instance.config.TotalMaxSize = 15
+
+	// one pass frees everything, there is nothing left for a quick re-run
+	require.False(t, instance.shouldRemove())
+	total, err := dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), total)
+	require.False(t, instance.localFileExist("big.txt"))
+}
+
+func TestStartEvictsImmediately(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{EvictionInterval: time.Hour}, dao)
+	ctx := context.TODO()
+	for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte("0123456789")}))
+	}
+	instance.config.TotalMaxSize = 10
+
+	go instance.Start()
+	require.Eventually(t, func() bool {
+		total, err := dao.TotalSize(ctx)
+		return err == nil && total <= 10
+	}, time.Second, 10*time.Millisecond)
+	require.True(t, instance.localFileExist("c.txt"))
+}
+
+func TestClose(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	stopped := make(chan struct{})
+	go func() {
+		instance.Start()
+		close(stopped)
+	}()
+	require.Eventually(t, func() bool {
+		instance.mut.Lock()
+		defer instance.mut.Unlock()
+		return instance.workerDone != nil
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, instance.Close())
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Start is still running after Close")
+	}
+	require.Error(t, instance.ctx.Err())
+	// closing twice is harmless
+	require.NoError(t, instance.Close())
+}
+
+func TestNotAuthenticated(t *testing.T) {
+	instance, err := New(context.Background(), []byte(fakeCredential), &Config{LocalFolderRoot: t.TempDir(), RemoteFolderRoot: "fake"},
+		NewMemoryDao(), nil)
+	require.NoError(t, err)
+	ctx := context.TODO()
+	require.ErrorIs(t, instance.Init(), ErrNotAuthenticated)
+	require.ErrorIs(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")}), ErrNotAuthenticated)
+	require.ErrorIs(t, instance.TouchFile(ctx, "a.txt"), ErrNotAuthenticated)
+	require.ErrorIs(t, instance.UploadAll(ctx), ErrNotAuthenticated)
+	_, err = instance.DownloadRange(ctx, "a.txt", 0, 1)
+	require.ErrorIs(t, err, ErrNotAuthenticated)
+	require.Nil(t, instance.getFileInCloud(ctx, "a.txt"))
+}
+
+func TestStoreFileResumesDroppedUpload(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{ResumableThreshold: 1024, UploadChunkSize: 256 * 1024}, dao)
+	ctx := context.TODO()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1 MiB, four chunks
+
+	// the connection drops after the second chunk was committed
+	fake.dropChunk = 2
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.bin", FileBytes: content, Description: "big"}))
+	require.Equal(t, 1, fake.callCount("session"))
+	require.Equal(t, len(content), fake.receivedBytes)
+
+	cloudFile := instance.getFileInCloud(ctx, "big.bin")
+	require.NotNil(t, cloudFile)
+	require.Equal(t, int64(len(content)), cloudFile.Size)
+	files, err := dao.QueryOldest(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, cloudFile.Id, files[0].FileID)
+	require.Equal(t, "big", files[0].Description)
+}
+
+func TestProgressFunc(t *testing.T) {
+	type progress struct {
+		path        string
+		done, total int64
+	}
+	var mut sync.Mutex
+	events := []progress{}
+	instance, _ := newFakeInstance(t, &Config{ProgressFunc: func(filepath string, bytesDone, bytesTotal int64) {
+		mut.Lock()
+		defer mut.Unlock()
+		events = append(events, progress{filepath, bytesDone, bytesTotal})
+	}}, NewMemoryDao())
+	ctx := context.TODO()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	total := int64(len(content))
+
+	check := func(path string) {
+		t.Helper()
+		mut.Lock()
+		defer mut.Unlock()
+		require.NotEmpty(t, events)
+		var last int64
+		for _, e := range events {
+			require.Equal(t, path, e.path)
+			require.Equal(t, total, e.total)
+			require.Greater(t, e.done, last)
+			last = e.done
+		}
+		require.Equal(t, total, last)
+		events = events[:0]
+	}
+
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.bin", FileBytes: content}))
+	check("big.bin")
+
+	require.NoError(t, os.Remove(instance.localFullPath("big.bin")))
+	require.NoError(t, instance.TouchFile(ctx, "big.bin"))
+	check("big.bin")
+
+	instance.config.ResumableThreshold = 1
+	instance.config.UploadChunkSize = 256 * 1024
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.bin", FileBytes: content, Replace: true}))
+	check("big.bin")
+}
+
+func TestSharedDrive(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{DriveID: "shared1", ResumableThreshold: 1024}, NewMemoryDao())
+	ctx := context.TODO()
+	fake.mut.Lock()
+	require.Equal(t, []string{"shared1"}, fake.files[instance.parentFolderID].meta.Parents)
+	fake.mut.Unlock()
+
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.bin", FileBytes: bytes.Repeat([]byte("b"), 2048)}))
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+	require.NoError(t, instance.TouchFile(ctx, "a.txt"))
+	require.NoError(t, instance.DeleteFile(ctx, "a.txt"))
+
+	// every list searches the shared drive and every other call supports it
+	require.Equal(t, fake.callCount("list"), fake.callCount("driveList"))
+	require.Equal(t, fake.callCount("list")+fake.callCount("create")+fake.callCount("session")+fake.callCount("download")+
+		fake.callCount("delete"), fake.callCount("allDrives"))
+}
+
+func TestSharedDriveLive(t *testing.T) {
+	driveID := os.Getenv("SHARED_DRIVE_ID")
+	if driveID == "" {
+		t.Skip("SHARED_DRIVE_ID is not set")
+	}
+	instance, err := createInstance(os.Getenv("CREDENTIAL_JSON"), os.Getenv("TOKEN_JSON"), &Config{
+		LocalFolderRoot:  t.TempDir(),
+		RemoteFolderRoot: "shareddrivetest",
+		DriveID:          driveID,
+	}, nil)
+	require.NoError(t, err)
+	defer instance.deleteRootFolder(context.Background(), true)
+
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")}))
+	driveFile := instance.getFileInCloud(ctx, "a.txt")
+	require.NotNil(t, driveFile)
+	remote, err := instance.filesGet(driveFile.Id).Fields("driveId").Context(ctx).Do()
+	require.NoError(t, err)
+	require.Equal(t, driveID, remote.DriveId)
+}
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{EncryptionKey: key}, dao)
+	ctx := context.TODO()
+	content := []byte("secret content")
+
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: content}))
+	local, err := os.ReadFile(instance.localFullPath("a.txt"))
+	require.NoError(t, err)
+	require.NotContains(t, string(local), string(content))
+	files, err := dao.QueryOldest(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), files[0].Size)
+	require.Equal(t, int64(len(local)), files[0].StoredSize)
+	require.Equal(t, int64(len(content)+28), files[0].StoredSize)
+
+	b, err := instance.ReadFile(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+
+	// a cache miss downloads and decrypts the stored bytes
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+	require.NoError(t, instance.TouchFile(ctx, "a.txt"))
+	b, err = instance.ReadFile(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	b, err = instance.DownloadRange(ctx, "a.txt", 7, 100)
+	require.NoError(t, err)
+	require.Equal(t, []byte("content"), b)
+
+	require.NoError(t, instance.StoreFileStream(ctx, "b.txt", bytes.NewReader(content), int64(len(content)), false))
+	r, err := instance.ReadFileStream(ctx, "b.txt")
+	require.NoError(t, err)
+	b, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, content, b)
+
+	// the wrong key fails to decrypt and caches nothing
+	instance.aead, err = newAEAD(bytes.Repeat([]byte("w"), 32))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+	require.NoError(t, dao.Delete(ctx, "a.txt"))
+	require.ErrorIs(t, instance.TouchFile(ctx, "a.txt"), ErrDecrypt)
+	require.False(t, instance.localFileExist("a.txt"))
+	_, err = instance.ReadFile(ctx, "b.txt")
+	require.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestEncryptionKeyLength(t *testing.T) {
+	_, err := New(context.Background(), []byte(fakeCredential), &Config{LocalFolderRoot: t.TempDir(), RemoteFolderRoot: "fake",
+		EncryptionKey: []byte("short")}, NewMemoryDao(), nil)
+	require.Error(t, err)
+}
+
+func TestCompress(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{Compress: true}, dao)
+	ctx := context.TODO()
+	compressible := bytes.Repeat([]byte("0123456789"), 10000)
+	incompressible := make([]byte, 10000)
+	_, err := rand.Read(incompressible)
+	require.NoError(t, err)
+
+	for name, content := range map[string][]byte{"text.txt": compressible, "random.bin": incompressible} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: name, FileBytes: content}))
+		local, err := os.ReadFile(instance.localFullPath(name))
+		require.NoError(t, err)
+		driveFile := instance.getFileInCloud(ctx, name)
+		require.NotNil(t, driveFile)
+		require.Equal(t, int64(len(local)), driveFile.Size)
+
+		// a cache miss inflates the downloaded bytes
+		require.NoError(t, os.Remove(instance.localFullPath(name)))
+		require.NoError(t, instance.TouchFile(ctx, name))
+		b, err := instance.ReadFile(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, content, b)
+	}
+	require.Equal(t, 2, fake.callCount("download"))
+
+	files, err := dao.QueryOldest(ctx, 2)
+	require.NoError(t, err)
+	var total int64
+	for _, f := range files {
+		if f.Filepath == "text.txt" {
+			require.Equal(t, int64(len(compressible)), f.Size)
+			require.Less(t, f.StoredSize, f.Size/10)
+		} else {
+			require.Equal(t, int64(len(incompressible)), f.Size)
+			require.Greater(t, f.StoredSize, f.Size)
+		}
+		total += f.DiskSize()
+	}
+	// the budget counts the compressed bytes on disk
+	daoBytes, diskBytes, err := instance.AuditSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, total, daoBytes)
+	require.Equal(t, diskBytes, daoBytes)
+
+	// turning compression off still reads the compressed files, a gzip file of the user is kept as is
+	instance.config.Compress = false
+	b, err := instance.ReadFile(ctx, "text.txt")
+	require.NoError(t, err)
+	require.Equal(t, compressible, b)
+	gz := &bytes.Buffer{}
+	zw := gzip.NewWriter(gz)
+	_, err = zw.Write(compressible)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "user.gz", FileBytes: gz.Bytes()}))
+	b, err = instance.ReadFile(ctx, "user.gz")
+	require.NoError(t, err)
+	require.Equal(t, gz.Bytes(), b)
+}
+
+func TestCompressEncrypted(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{Compress: true, EncryptionKey: bytes.Repeat([]byte("k"), 32)}, NewMemoryDao())
+	ctx := context.TODO()
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: content}))
+	local, err := os.ReadFile(instance.localFullPath("a.txt"))
+	require.NoError(t, err)
+	require.Less(t, len(local), len(content)/10)
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+	b, err := instance.ReadFile(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+}
+
+type captureLogger struct {
+	mut      sync.Mutex
+	messages []string
+}
+
+func (l *captureLogger) add(level, format string, args ...interface{}) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) { l.add("debug", format, args...) }
+func (l *captureLogger) Infof(format string, args ...interface{})  { l.add("info", format, args...) }
+func (l *captureLogger) Warnf(format string, args ...interface{})  { l.add("warn", format, args...) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.add("error", format, args...) }
+
+func TestLogger(t *testing.T) {
+	logger := &captureLogger{}
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{Logger: logger}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.storeFileToLocal(ctx, "a.txt", []byte("0123456789")))
+	require.NoError(t, instance.UploadAll(ctx))
+
+	instance.config.TotalMaxSize = 5
+	instance.shouldRemove()
+
+	logger.mut.Lock()
+	defer logger.mut.Unlock()
+	require.Contains(t, logger.messages, "debug uploading a.txt from upload all")
+	require.Contains(t, logger.messages, "debug total size 10 exceeded 5")
+}
+
+type countingMetrics struct {
+	mut                     sync.Mutex
+	hits, misses, evictions int
+	uploads                 int
+	uploadedBytes           int64
+}
+
+func (m *countingMetrics) IncHit() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.hits++
+}
+
+func (m *countingMetrics) IncMiss() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.misses++
+}
+
+func (m *countingMetrics) ObserveUpload(bytes int64, d time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.uploads++
+	m.uploadedBytes += bytes
+}
+
+func (m *countingMetrics) IncEviction(count int) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.evictions += count
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &countingMetrics{}
+	instance, _ := newFakeInstance(t, &Config{Metrics: metrics}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("0123456789")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("01234")}))
+	require.Equal(t, 2, metrics.uploads)
+	require.Equal(t, int64(15), metrics.uploadedBytes)
+
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+	require.NoError(t, instance.TouchFile(ctx, "a.txt"))
+	require.Equal(t, 0, metrics.hits)
+	require.Equal(t, 1, metrics.misses)
+	require.NoError(t, instance.TouchFile(ctx, "a.txt"))
+	require.Equal(t, 1, metrics.hits)
+	require.Equal(t, 1, metrics.misses)
+
+	// b.txt is the least recently used
+	instance.config.TotalMaxSize = 10
+	instance.shouldRemove()
+	require.Equal(t, 1, metrics.evictions)
+	require.True(t, instance.localFileExist("a.txt"))
+}
+
+func TestRename(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a"), Priority: 2}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("b")}))
+	// b.txt has the lower priority and comes first
+	before, err := dao.QueryOldest(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, "b.txt", before[0].Filepath)
+	fileID := instance.getFileInCloud(ctx, "a.txt").Id
+
+	// the local copy is moved along
+	require.NoError(t, instance.Rename(ctx, "a.txt", "dir/c.txt"))
+	require.False(t, instance.localFileExist("a.txt"))
+	require.Nil(t, instance.getFileInCloud(ctx, "a.txt"))
+	require.Equal(t, fileID, instance.getFileInCloud(ctx, "dir/c.txt").Id)
+	b, err := instance.ReadFile(ctx, "dir/c.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), b)
+	files, err := dao.QueryOldest(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	for _, f := range files {
+		require.NotEqual(t, "a.txt", f.Filepath)
+		if f.Filepath == "dir/c.txt" {
+			require.Equal(t, fileID, f.FileID)
+			require.Equal(t, 2, f.Priority)
+		}
+	}
+
+	// only the google drive copy is left
+	require.NoError(t, os.Remove(instance.localFullPath("b.txt")))
+	require.NoError(t, instance.Rename(ctx, "b.txt", "d.txt"))
+	require.False(t, instance.localFileExist("d.txt"))
+	files, err = dao.QueryOldest(ctx, 2)
+	require.NoError(t, err)
+	for _, f := range files {
+		if f.Filepath == "d.txt" {
+			require.Equal(t, before[0].LastAccess, f.LastAccess)
+		}
+	}
+	downloads := fake.callCount("download")
+	require.NoError(t, instance.TouchFile(ctx, "d.txt"))
+	require.Equal(t, downloads+1, fake.callCount("download"))
+	b, err = instance.ReadFile(ctx, "d.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), b)
+
+	require.ErrorIs(t, instance.Rename(ctx, "d.txt", "dir/c.txt"), ErrFileExist)
+	require.ErrorIs(t, instance.Rename(ctx, "missing.txt", "e.txt"), ErrNotFound)
+}
+
+func TestRenameNativeFolders(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{UseNativeFolders: true}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "x/a.txt", FileBytes: []byte("a")}))
+	require.NoError(t, instance.Rename(ctx, "x/a.txt", "y/z/b.txt"))
+	driveFile := instance.getFileInCloud(ctx, "y/z/b.txt")
+	require.NotNil(t, driveFile)
+	require.Equal(t, "b.txt", driveFile.Name)
+	require.Nil(t, instance.getFileInCloud(ctx, "x/a.txt"))
+	require.NoError(t, os.Remove(instance.localFullPath("y/z/b.txt")))
+	b, err := instance.ReadFile(ctx, "y/z/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), b)
+}
+
+func TestGetFileInfo(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("abc")}))
+	calls := fake.callCount("list") + fake.callCount("get")
+
+	fileInfo, err := instance.GetFileInfo(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", fileInfo.Filepath)
+	require.Equal(t, int64(3), fileInfo.Size)
+	require.NotEmpty(t, fileInfo.FileID)
+	require.False(t, fileInfo.LastAccess.IsZero())
+	require.Equal(t, calls, fake.callCount("list")+fake.callCount("get"))
+
+	_, err = instance.GetFileInfo(ctx, "missing.txt")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestTouchFileUsesDaoFileID(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: []byte("a")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "b.txt", FileBytes: []byte("b")}))
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+
+	lists := fake.callCount("list")
+	require.NoError(t, instance.TouchFile(ctx, "a.txt"))
+	require.Equal(t, lists, fake.callCount("list"))
+	b, err := instance.ReadFile(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), b)
+
+	// a stale id falls back to the lookup by name
+	require.NoError(t, os.Remove(instance.localFullPath("b.txt")))
+	fileInfo, err := dao.Get(ctx, "b.txt")
+	require.NoError(t, err)
+	fileInfo.FileID = "stale"
+	require.NoError(t, dao.InsertOrUpdate(ctx, fileInfo))
+	require.NoError(t, instance.TouchFile(ctx, "b.txt"))
+	require.Greater(t, fake.callCount("list"), lists)
+	fileInfo, err = dao.Get(ctx, "b.txt")
+	require.NoError(t, err)
+	require.Equal(t, instance.getFileInCloud(ctx, "b.txt").Id, fileInfo.FileID)
+}
+
+func TestDownloadAll(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	paths := []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"}
+	for _, p := range paths {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte("content " + p)}))
+	}
+
+	// a fresh machine with an empty local folder and dao
+	fresh, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	fresh.driveService = instance.driveService
+	fresh.parentFolderID = instance.parentFolderID
+	require.NoError(t, fresh.DownloadAll(ctx))
+	for _, p := range paths {
+		require.True(t, fresh.localFileExist(p))
+		b, err := fresh.ReadFile(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, []byte("content "+p), b)
+		fileInfo, err := fresh.GetFileInfo(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, instance.getFileInCloud(ctx, p).Id, fileInfo.FileID)
+	}
+}
+
+func TestDownloadAllWithinBudget(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: fmt.Sprintf("%d.txt", i), FileBytes: []byte("0123456789")}))
+	}
+
+	// room for two of the five files
+	fresh, _ := newFakeInstance(t, &Config{TotalMaxSize: 25}, NewMemoryDao())
+	fresh.driveService = instance.driveService
+	fresh.parentFolderID = instance.parentFolderID
+	require.NoError(t, fresh.DownloadAll(ctx))
+	total, err := fresh.dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), total)
+	cached := 0
+	for i := 0; i < 5; i++ {
+		if fresh.localFileExist(fmt.Sprintf("%d.txt", i)) {
+			cached++
+		}
+	}
+	require.Equal(t, 2, cached)
+
+	// the next run continues from the cached bytes
+	fresh.config.TotalMaxSize = 35
+	require.NoError(t, fresh.DownloadAll(ctx))
+	total, err = fresh.dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(30), total)
+}
+
+func TestReadRange(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.bin", FileBytes: content}))
+
+	// a cached file is read locally
+	downloads := fake.callCount("download")
+	b, err := instance.ReadRange(ctx, "a.bin", 5, 10)
+	require.NoError(t, err)
+	require.Equal(t, content[5:15], b)
+	require.Equal(t, downloads, fake.callCount("download"))
+
+	// a miss fetches only the range
+	require.NoError(t, os.Remove(instance.localFullPath("a.bin")))
+	b, err = instance.ReadRange(ctx, "a.bin", 30, 6)
+	require.NoError(t, err)
+	require.Equal(t, content[30:], b)
+	require.Equal(t, downloads+1, fake.callCount("download"))
+	require.Equal(t, 6, fake.downloadedBytes)
+	require.False(t, instance.localFileExist("a.bin"))
+
+	for _, r := range [][2]int64{{-1, 5}, {0, 0}, {30, 7}, {36, 1}} {
+		_, err = instance.ReadRange(ctx, "a.bin", r[0], r[1])
+		require.ErrorIs(t, err, ErrInvalidRange, "range %v", r)
+	}
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.bin", FileBytes: content, Replace: true}))
+	_, err = instance.ReadRange(ctx, "a.bin", 30, 7)
+	require.ErrorIs(t, err, ErrInvalidRange)
+
+	// an oversized range fails before anything is read, cached or not
+	downloads = fake.callCount("download")
+	_, err = instance.ReadRange(ctx, "a.bin", 0, 1<<62)
+	require.ErrorIs(t, err, ErrInvalidRange)
+	require.NoError(t, os.Remove(instance.localFullPath("a.bin")))
+	_, err = instance.ReadRange(ctx, "a.bin", 1, math.MaxInt64)
+	require.ErrorIs(t, err, ErrInvalidRange)
+	require.Equal(t, downloads, fake.callCount("download"))
+}
+
+func TestEvictionTargetBytes(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: fmt.Sprintf("%d.txt", i), FileBytes: []byte("0123456789")}))
+	}
+
+	// without a target eviction stops right below the max
+	instance.config.TotalMaxSize = 95
+	instance.shouldRemove()
+	total, err := dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(90), total)
+
+	instance.config.TotalMaxSize = 85
+	target := int64(50)
+	require.NoError(t, instance.UpdateConfig(ConfigPatch{EvictionTargetBytes: &target}))
+	instance.shouldRemove()
+	total, err = dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.LessOrEqual(t, total, target)
+	require.Equal(t, int64(50), total)
+	require.True(t, instance.localFileExist("9.txt"))
+	require.False(t, instance.localFileExist("4.txt"))
+
+	// below the max nothing is evicted even above the target
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "new.txt", FileBytes: []byte("0123456789")}))
+	instance.shouldRemove()
+	total, err = dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(60), total)
+}
+
+func TestEvictionSkipsLockedFiles(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte("0123456789")}))
+	}
+	instance.config.TotalMaxSize = 20
+
+	// a.txt is the oldest but held by a running read
+	unlock := instance.pathLocks.lock("a.txt")
+	instance.shouldRemove()
+	require.True(t, instance.localFileExist("a.txt"))
+	require.False(t, instance.localFileExist("b.txt"))
+	require.True(t, instance.localFileExist("c.txt"))
+
+	// the eviction released its locks
+	unlockB, ok := instance.pathLocks.tryLock("b.txt")
+	require.True(t, ok)
+	unlockB()
+	_, ok = instance.pathLocks.tryLock("a.txt")
+	require.False(t, ok)
+	unlock()
+	instance.config.TotalMaxSize = 10
+	require.False(t, instance.shouldRemove())
+	require.False(t, instance.localFileExist("a.txt"))
+	require.True(t, instance.localFileExist("c.txt"))
+}
+
+func TestDeleteDir(t *testing.T) {
+	for _, native := range []bool{false, true} {
+		t.Run(fmt.Sprintf("native=%v", native), func(t *testing.T) {
+			dao := NewMemoryDao()
+			instance, fake := newFakeInstance(t, &Config{UseNativeFolders: native}, dao)
+			ctx := context.TODO()
+			removed := []string{"dir/a.txt", "dir/b.txt", "dir/sub/c.txt"}
+			kept := []string{"dirx/d.txt", "other.txt"}
+			for _, p := range append(append([]string{}, removed...), kept...) {
+				require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte(p)}))
+			}
+			// an evicted file is only left on google drive
+			require.NoError(t, os.Remove(instance.localFullPath("dir/b.txt")))
+
+			require.NoError(t, instance.DeleteDir(ctx, "dir/"))
+			for _, p := range removed {
+				local, remote, err := instance.Exists(ctx, p)
+				require.NoError(t, err)
+				require.False(t, local, p)
+				require.False(t, remote, p)
+				_, err = dao.Get(ctx, p)
+				require.ErrorIs(t, err, ErrNotFound)
+			}
+			for _, p := range kept {
+				b, err := instance.ReadFile(ctx, p)
+				require.NoError(t, err)
+				require.Equal(t, []byte(p), b)
+			}
+			_, err := os.Stat(instance.localFullPath("dir"))
+			require.True(t, os.IsNotExist(err))
+			if native {
+				fake.mut.Lock()
+				for _, file := range fake.files {
+					require.NotEqual(t, "dir", file.meta.Name)
+				}
+				fake.mut.Unlock()
+			}
+			require.Error(t, instance.DeleteDir(ctx, ""))
+		})
+	}
+}
+
+func TestDeleteDirInvalidPath(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{}, dao)
+	ctx := context.TODO()
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "dir/a.txt", FileBytes: []byte("a")}))
+	outside := path.Join(path.Dir(instance.config.LocalFolderRoot), "outside.txt")
+	require.NoError(t, os.WriteFile(outside, []byte("outside"), 0600))
+	defer os.Remove(outside)
+
+	for _, prefix := range []string{"", "/", ".", "./", "..", "../", "dir/../..", "../dir", "dir/../../x", "/dir", "/etc"} {
+		require.ErrorIs(t, instance.DeleteDir(ctx, prefix), ErrInvalidPath, prefix)
+	}
+	_, err := os.Stat(outside)
+	require.NoError(t, err)
+	require.True(t, instance.localFileExist("dir/a.txt"))
+	count, err := dao.Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// a prefix that stays inside the root is cleaned
+	require.NoError(t, instance.DeleteDir(ctx, "./dir/sub/.."))
+	require.False(t, instance.localFileExist("dir/a.txt"))
+}
+
+func TestCachedFileCount(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	for _, p := range []string{"a.txt", "b.txt"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: p, FileBytes: []byte(p)}))
+	}
+	count, err := instance.CachedFileCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.NoError(t, instance.DeleteFile(ctx, "a.txt"))
+	count, err = instance.CachedFileCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestMaxFileCount(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, _ := newFakeInstance(t, &Config{TotalMaxSize: 1 << 30, MaxFileCount: 3}, dao)
+	ctx := context.TODO()
+	for i := 0; i < 6; i++ {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: fmt.Sprintf("%d.txt", i), FileBytes: []byte("0123456789")}))
+	}
+	require.NoError(t, instance.SetPriority(ctx, "0.txt", 1))
+
+	// far below the size cap, the count alone evicts the least recently used files
+	require.False(t, instance.shouldRemove())
+	count, err := instance.CachedFileCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	for i, cached := range []bool{true, false, false, false, true, true} {
+		require.Equal(t, cached, instance.localFileExist(fmt.Sprintf("%d.txt", i)), i)
+	}
+
+	// with both limits the stricter one decides
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "big.txt", FileBytes: bytes.Repeat([]byte("x"), 100)}))
+	instance.config.TotalMaxSize = 110
+	require.False(t, instance.shouldRemove())
+	count, err = instance.CachedFileCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	total, err := dao.TotalSize(ctx)
+	require.NoError(t, err)
+	require.LessOrEqual(t, total, int64(110))
+	require.True(t, instance.localFileExist("big.txt"))
+}
+
+func TestTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dao := NewMemoryDaoWithClock(clock)
+	instance, _ := newFakeInstance(t, &Config{Clock: clock, TotalMaxSize: 1 << 30, TTL: time.Hour}, dao)
+	ctx := context.TODO()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: name, FileBytes: []byte("0123456789")}))
+	}
+	require.NoError(t, instance.SetPriority(ctx, "d.txt", 1))
+
+	// nothing is old enough yet
+	instance.shouldRemove()
+	count, err := instance.CachedFileCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	clock.Add(90 * time.Minute)
+	require.NoError(t, instance.TouchFile(ctx, "b.txt"))
+	unlock := instance.pathLocks.lock("c.txt")
+	instance.shouldRemove()
+	unlock()
+
+	// far below the size cap the expired file is evicted, the touched and the locked file stay
+	require.False(t, instance.localFileExist("a.txt"))
+	require.True(t, instance.localFileExist("b.txt"))
+	require.True(t, instance.localFileExist("c.txt"))
+	require.False(t, instance.localFileExist("d.txt"))
+
+	// the locked file is expired on the next pass
+	instance.shouldRemove()
+	require.False(t, instance.localFileExist("c.txt"))
+	count, err = instance.CachedFileCount(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestStoreFileToLocalAtomic(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	small := []byte("small")
+	large := bytes.Repeat([]byte("large"), 1<<16)
+	require.NoError(t, instance.storeFileToLocal(ctx, "a.txt", small))
+
+	// a reader racing the rewrites only ever sees one of the complete contents
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			b, err := os.ReadFile(instance.localFullPath("a.txt"))
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(b, small) || bytes.Equal(b, large), "read %d bytes", len(b))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		content := large
+		if i%2 == 1 {
+			content = small
+		}
+		require.NoError(t, instance.storeFileToLocal(ctx, "a.txt", content))
+	}
+	close(done)
+	wg.Wait()
+
+	// a failed rename leaves no temporary file behind
+	require.NoError(t, os.MkdirAll(path.Join(instance.localFullPath("b.txt"), "blocker"), os.ModePerm))
+	require.Error(t, instance.storeFileToLocal(ctx, "b.txt", large))
+	require.NoError(t, os.RemoveAll(instance.localFullPath("b.txt")))
+	entries, err := os.ReadDir(instance.config.LocalFolderRoot)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// a temporary file left by a crash is never taken for a cached file, nor is a user file named like one
+	require.NoError(t, os.WriteFile(path.Join(instance.config.LocalFolderRoot, tmpPrefix+"crashed"), large, 0600))
+	require.NoError(t, instance.storeFileToLocal(ctx, "c.tmp", small))
+	b, err := os.ReadFile(instance.localFullPath("a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, small, b)
+	result, err := instance.UploadAllWithResult(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.txt", "c.tmp"}, result.Uploaded)
+	untracked, err := instance.UntrackedLocal(ctx)
+	require.NoError(t, err)
+	require.Empty(t, untracked)
+}
+
+func TestFileMode(t *testing.T) {
+	ctx := context.TODO()
+	mode := func(p string) os.FileMode {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		return info.Mode().Perm()
+	}
+
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "dir/a.txt", FileBytes: []byte("a")}))
+	require.Equal(t, os.FileMode(0600), mode(instance.localFullPath("dir/a.txt")))
+	require.Equal(t, os.FileMode(0700), mode(path.Dir(instance.localFullPath("dir/a.txt"))))
+
+	// the modes are set explicitly, the umask of the process does not narrow them
+	instance, _ = newFakeInstance(t, &Config{FileMode: 0666, DirMode: 0777}, NewMemoryDao())
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "dir/sub/a.txt", FileBytes: []byte("a")}))
+	require.NoError(t, instance.StoreFileStream(ctx, "dir/b.txt", strings.NewReader("b"), 1, false))
+	require.Equal(t, os.FileMode(0666), mode(instance.localFullPath("dir/sub/a.txt")))
+	require.Equal(t, os.FileMode(0666), mode(instance.localFullPath("dir/b.txt")))
+	require.Equal(t, os.FileMode(0777), mode(instance.localFullPath("dir/sub")))
+	require.Equal(t, os.FileMode(0777), mode(instance.localFullPath("dir")))
+}
+
+func TestDetectMimeType(t *testing.T) {
+	dao := NewMemoryDao()
+	instance, fake := newFakeInstance(t, &Config{ResumableThreshold: 1 << 20}, dao)
+	ctx := context.TODO()
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "image.png", FileBytes: []byte("not really a png")}))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "sniffed", FileBytes: png}))
+	require.NoError(t, instance.StoreFileStream(ctx, "streamed", bytes.NewReader(png), int64(len(png)), false))
+	require.NoError(t, instance.StoreFileStream(ctx, "unbuffered", io.MultiReader(bytes.NewReader(png)), int64(len(png)), false))
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "large", FileBytes: append(png, make([]byte, 1<<20)...)}))
+
+	for _, p := range []string{"image.png", "sniffed", "streamed", "unbuffered", "large"} {
+		info, err := instance.GetFileInfo(ctx, p)
+		require.NoError(t, err)
+		require.Equal(t, "image/png", info.MimeType, p)
+		require.Equal(t, "image/png", fake.files[info.FileID].meta.MimeType, p)
+	}
+	// the sniffed bytes are still uploaded and cached
+	b, err := instance.ReadFile(ctx, "unbuffered")
+	require.NoError(t, err)
+	require.Equal(t, png, b)
+	info, err := instance.GetFileInfo(ctx, "unbuffered")
+	require.NoError(t, err)
+	require.Equal(t, png, fake.files[info.FileID].content)
+}
+
+func TestReadFileStreamConcurrentMiss(t *testing.T) {
+	instance, _ := newFakeInstance(t, &Config{}, NewMemoryDao())
+	ctx := context.TODO()
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "a.txt", FileBytes: content}))
+	require.NoError(t, os.Remove(instance.localFullPath("a.txt")))
+
+	// both misses fill their own temporary file
+	first, err := instance.ReadFileStream(ctx, "a.txt")
+	require.NoError(t, err)
+	second, err := instance.ReadFileStream(ctx, "a.txt")
+	require.NoError(t, err)
+	for _, r := range []io.Reader{first, second} {
+		_, err := io.CopyN(io.Discard, r, 5000)
+		require.NoError(t, err)
+	}
+	for _, r := range []io.Reader{first, second} {
+		_, err := io.Copy(io.Discard, r)
+		require.NoError(t, err)
+	}
+	require.NoError(t, first.Close())
+	require.NoError(t, second.Close())
+
+	b, err := os.ReadFile(instance.localFullPath("a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	entries, err := os.ReadDir(instance.config.LocalFolderRoot)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestRefreshToken(t *testing.T) {
+	refreshed := []string{}
+	refreshMut := sync.Mutex{}
+	instance, _ := newFakeInstance(t, &Config{OnTokenRefresh: func(token *oauth2.Token) {
+		refreshMut.Lock()
+		defer refreshMut.Unlock()
+		refreshed = append(refreshed, token.AccessToken)
+	}}, NewMemoryDao())
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "refresh", r.Form.Get("refresh_token"))
+		refreshMut.Lock()
+		requests++
+		n := requests
+		refreshMut.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"fresh-%d","refresh_token":"refresh","token_type":"Bearer","expires_in":3600}`, n)
+	}))
+	defer srv.Close()
+	instance.oauthConfig.Endpoint.TokenURL = srv.URL
+	require.NoError(t, instance.setToken(&oauth2.Token{AccessToken: "stale", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}))
+	ctx := context.TODO()
+
+	// operations keep running while the token is swapped
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: fmt.Sprintf("%d.txt", i), FileBytes: []byte("a")}))
+		}(i)
+	}
+	token, err := instance.RefreshToken(ctx)
+	wg.Wait()
+	require.NoError(t, err)
+	require.Equal(t, "fresh-1", token.AccessToken)
+
+	current, err := instance.tokens().Token()
+	require.NoError(t, err)
+	require.Equal(t, "fresh-1", current.AccessToken)
+	refreshMut.Lock()
+	require.Equal(t, []string{"fresh-1"}, refreshed)
+	refreshMut.Unlock()
+	_, err = instance.ReadFile(ctx, "0.txt")
+	require.NoError(t, err)
+
+	// a logged out instance has nothing to refresh
+	instance.authMut.Lock()
+	instance.tokenSource = nil
+	instance.authMut.Unlock()
+	_, err = instance.RefreshToken(ctx)
+	require.ErrorIs(t, err, ErrNotAuthenticated)
+}
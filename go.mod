@@ -3,9 +3,12 @@ module github.com/apinprastya/gdrive
 go 1.20
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/oauth2 v0.9.0
+	golang.org/x/sync v0.3.0
+	golang.org/x/time v0.3.0
 	google.golang.org/api v0.128.0
 	gopkg.in/typ.v4 v4.3.0
 )
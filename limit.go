@@ -0,0 +1,115 @@
+package gdrive
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// limitTransport bounds the number of in-flight google drive requests across every operation.
+// A slot is held until the response body is closed, so streamed downloads count as well.
+type limitTransport struct {
+	base  http.RoundTripper
+	slots func() chan struct{} // current slots of Config.MaxConcurrentAPICalls, nil when unlimited
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a request releases the slot it took even when the limit changes meanwhile
+	sem := t.slots()
+	if sem == nil {
+		return t.base.RoundTrip(req)
+	}
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, req.Context().Err()
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		<-sem
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { <-sem }}
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// rateTransport spaces out google drive requests to stay under the per user quota
+type rateTransport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+func (t *rateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.limiter.Wait(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newAPISlots returns the semaphore of the api call limit, nil when unlimited
+func newAPISlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+// requestRate returns the limiter rate of Config.RequestsPerSecond, unlimited when it is not set
+func requestRate(perSecond float64) rate.Limit {
+	if perSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perSecond)
+}
+
+func (g *GDrive) apiSlots() chan struct{} {
+	g.configMut.RLock()
+	defer g.configMut.RUnlock()
+	return g.apiSem
+}
+
+// limitClient wraps the client transport with the global api call limit of Config.MaxConcurrentAPICalls and the
+// global request rate of Config.RequestsPerSecond. Both are always wrapped so UpdateConfig can change them later.
+func (g *GDrive) limitClient(client *http.Client) *http.Client {
+	g.configMut.Lock()
+	if g.apiSem == nil {
+		g.apiSem = newAPISlots(g.config.MaxConcurrentAPICalls)
+	}
+	if g.apiLimiter == nil {
+		g.apiLimiter = rate.NewLimiter(requestRate(g.config.RequestsPerSecond), 1)
+	}
+	limiter := g.apiLimiter
+	g.configMut.Unlock()
+
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	base = &limitTransport{base: base, slots: g.apiSlots}
+	// requests wait for the rate before taking a slot
+	base = &rateTransport{base: base, limiter: limiter}
+	limited := *client
+	limited.Transport = base
+	return &limited
+}
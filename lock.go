@@ -0,0 +1,60 @@
+package gdrive
+
+import "sync"
+
+// keyedMutex serializes the operations on the same path while different paths run in parallel
+type keyedMutex struct {
+	mut   sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mut  sync.Mutex
+	refs int
+}
+
+// lock blocks until the key is free and returns the function releasing it
+func (k *keyedMutex) lock(key string) func() {
+	k.mut.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyedLock{}
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mut.Unlock()
+
+	l.mut.Lock()
+	return k.unlocker(key, l)
+}
+
+// tryLock takes the key only when nobody holds or waits for it, ok is false when it is busy
+func (k *keyedMutex) tryLock(key string) (unlock func(), ok bool) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	if k.locks == nil {
+		k.locks = map[string]*keyedLock{}
+	}
+	if _, busy := k.locks[key]; busy {
+		return nil, false
+	}
+	l := &keyedLock{refs: 1}
+	l.mut.Lock()
+	k.locks[key] = l
+	return k.unlocker(key, l), true
+}
+
+func (k *keyedMutex) unlocker(key string, l *keyedLock) func() {
+	return func() {
+		l.mut.Unlock()
+		k.mut.Lock()
+		// the entry is dropped once nobody waits for it so the map does not grow with every path
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mut.Unlock()
+	}
+}
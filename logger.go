@@ -0,0 +1,26 @@
+package gdrive
+
+import "github.com/sirupsen/logrus"
+
+// Logger receives the log messages of an instance, set it in Config.Logger. The default writes to the standard
+// logrus logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type logrusLogger struct{}
+
+func (logrusLogger) Debugf(format string, args ...interface{}) { logrus.Debugf(format, args...) }
+func (logrusLogger) Infof(format string, args ...interface{})  { logrus.Infof(format, args...) }
+func (logrusLogger) Warnf(format string, args ...interface{})  { logrus.Warnf(format, args...) }
+func (logrusLogger) Errorf(format string, args ...interface{}) { logrus.Errorf(format, args...) }
+
+func (g *GDrive) logger() Logger {
+	if g.config.Logger == nil {
+		return logrusLogger{}
+	}
+	return g.config.Logger
+}
@@ -1,8 +1,10 @@
 package gdrive
 
 import (
+	"container/heap"
 	"context"
-	"errors"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,24 +12,41 @@ import (
 )
 
 type Memory struct {
-	mut  sync.Mutex
-	data []FileInfo
+	mut   sync.Mutex
+	data  []FileInfo
+	clock Clock
 }
 
 func NewMemoryDao() *Memory {
+	return NewMemoryDaoWithClock(nil)
+}
+
+// NewMemoryDaoWithClock creates a memory dao using the clock for a FileInfo inserted without LastAccess.
+// GDrive always sets LastAccess from Config.Clock, NewMemoryDao is enough with it.
+func NewMemoryDaoWithClock(clock Clock) *Memory {
 	return &Memory{
-		mut:  sync.Mutex{},
-		data: []FileInfo{},
+		mut:   sync.Mutex{},
+		data:  []FileInfo{},
+		clock: clock,
 	}
 }
 
+func (m *Memory) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock.Now()
+}
+
 func (m *Memory) InsertOrUpdate(ctx context.Context, fileInfo *FileInfo) error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
 
 	idx := slices.IndexFunc(m.data, func(data FileInfo) bool { return data.Filepath == fileInfo.Filepath })
+	if fileInfo.LastAccess.IsZero() {
+		fileInfo.LastAccess = m.now()
+	}
 	if idx >= 0 {
-		fileInfo.LastAccess = time.Now()
 		m.data[idx] = *fileInfo
 	} else {
 		m.data = append(m.data, *fileInfo)
@@ -48,13 +67,52 @@ func (m *Memory) Touch(ctx context.Context, filepathName string, date time.Time)
 	return nil
 }
 
+func (m *Memory) SetPriority(ctx context.Context, filepathName string, priority int) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	idx := slices.IndexFunc(m.data, func(data FileInfo) bool { return data.Filepath == filepathName })
+	if idx < 0 {
+		return ErrNotFound
+	}
+	m.data[idx].Priority = priority
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, filepathName string) (*FileInfo, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	idx := slices.IndexFunc(m.data, func(data FileInfo) bool { return data.Filepath == filepathName })
+	if idx < 0 {
+		return nil, ErrNotFound
+	}
+	fileInfo := m.data[idx]
+	return &fileInfo, nil
+}
+
+func (m *Memory) Rename(ctx context.Context, oldPath, newPath string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	idx := slices.IndexFunc(m.data, func(data FileInfo) bool { return data.Filepath == oldPath })
+	if idx < 0 {
+		return ErrNotFound
+	}
+	if slices.IndexFunc(m.data, func(data FileInfo) bool { return data.Filepath == newPath }) >= 0 {
+		return ErrFileExist
+	}
+	m.data[idx].Filepath = newPath
+	return nil
+}
+
 func (m *Memory) Delete(ctx context.Context, filepathName string) error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
 
 	idx := slices.IndexFunc(m.data, func(data FileInfo) bool { return data.Filepath == filepathName })
 	if idx < 0 {
-		return errors.New("file not found")
+		return ErrNotFound
 	}
 	slices.Remove(&m.data, idx)
 	return nil
@@ -66,17 +124,87 @@ func (m *Memory) TotalSize(ctx context.Context) (int64, error) {
 
 	var total int64
 	for i := range m.data {
-		total += m.data[i].Size
+		total += m.data[i].DiskSize()
 	}
 
 	return total, nil
 }
 
+func (m *Memory) QueryByPrefix(ctx context.Context, prefix string) ([]FileInfo, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	retVal := []FileInfo{}
+	for i := range m.data {
+		if strings.HasPrefix(m.data[i].Filepath, prefix) {
+			retVal = append(retVal, m.data[i])
+		}
+	}
+	return retVal, nil
+}
+
+func (m *Memory) QueryExpired(ctx context.Context, before time.Time) ([]FileInfo, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	retVal := []FileInfo{}
+	for i := range m.data {
+		if m.data[i].LastAccess.Before(before) {
+			retVal = append(retVal, m.data[i])
+		}
+	}
+	return retVal, nil
+}
+
+func (m *Memory) LatestAccess(ctx context.Context) (time.Time, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	var latest time.Time
+	for i := range m.data {
+		if m.data[i].LastAccess.After(latest) {
+			latest = m.data[i].LastAccess
+		}
+	}
+	return latest, nil
+}
+
+func (m *Memory) Count(ctx context.Context) (int, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return len(m.data), nil
+}
+
+func (m *Memory) CountByContentHash(ctx context.Context, hash string) (int, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	count := 0
+	for i := range m.data {
+		if m.data[i].ContentHash == hash {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *Memory) SizeByMimeType(ctx context.Context) (map[string]int64, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	retVal := map[string]int64{}
+	for i := range m.data {
+		retVal[m.data[i].MimeType] += m.data[i].Size
+	}
+
+	return retVal, nil
+}
+
 func (m *Memory) QueryOldest(ctx context.Context, limit int) ([]FileInfo, error) {
 	m.mut.Lock()
 	defer m.mut.Unlock()
 
-	slices.SortFunc(m.data, func(a, b FileInfo) bool { return a.LastAccess.Before(b.LastAccess) })
+	slices.SortFunc(m.data, evictsBefore)
 	retVal := []FileInfo{}
 	for i := 0; i < limit; i++ {
 		if i >= len(m.data) {
@@ -87,3 +215,53 @@ func (m *Memory) QueryOldest(ctx context.Context, limit int) ([]FileInfo, error)
 
 	return retVal, nil
 }
+
+// QueryOldestAfter keeps only the first limit files in a heap instead of sorting the whole cache
+func (m *Memory) QueryOldestAfter(ctx context.Context, cursor *FileInfo, limit int) ([]FileInfo, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if limit <= 0 {
+		return []FileInfo{}, nil
+	}
+	last := &lastFirst{}
+	for i := range m.data {
+		if cursor != nil && !evictsBefore(*cursor, m.data[i]) {
+			continue
+		}
+		if last.Len() < limit {
+			heap.Push(last, m.data[i])
+		} else if evictsBefore(m.data[i], (*last)[0]) {
+			(*last)[0] = m.data[i]
+			heap.Fix(last, 0)
+		}
+	}
+	retVal := []FileInfo(*last)
+	sort.Slice(retVal, func(i, j int) bool { return evictsBefore(retVal[i], retVal[j]) })
+	return retVal, nil
+}
+
+// evictsBefore is the eviction order: lower priorities first, then the least recently accessed, then by path
+func evictsBefore(a, b FileInfo) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	if !a.LastAccess.Equal(b.LastAccess) {
+		return a.LastAccess.Before(b.LastAccess)
+	}
+	return a.Filepath < b.Filepath
+}
+
+// lastFirst is a heap with the file evicted last on top
+type lastFirst []FileInfo
+
+func (h lastFirst) Len() int           { return len(h) }
+func (h lastFirst) Less(i, j int) bool { return evictsBefore(h[j], h[i]) }
+func (h lastFirst) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *lastFirst) Push(x any)        { *h = append(*h, x.(FileInfo)) }
+func (h *lastFirst) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,209 @@
+package gdrive
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySizeByMimeType(t *testing.T) {
+	dao := NewMemoryDao()
+	dao.InsertOrUpdate(context.TODO(), &FileInfo{Filepath: "a.txt", Size: 10, MimeType: "text/plain", LastAccess: time.Now()})
+	dao.InsertOrUpdate(context.TODO(), &FileInfo{Filepath: "b.txt", Size: 5, MimeType: "text/plain", LastAccess: time.Now()})
+	dao.InsertOrUpdate(context.TODO(), &FileInfo{Filepath: "c.png", Size: 7, MimeType: "image/png", LastAccess: time.Now()})
+
+	sizes, err := dao.SizeByMimeType(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"text/plain": 15, "image/png": 7}, sizes)
+}
+
+func TestMemoryQueryOldestPriority(t *testing.T) {
+	dao := NewMemoryDao()
+	now := time.Now()
+	dao.InsertOrUpdate(context.TODO(), &FileInfo{Filepath: "old.txt", LastAccess: now.Add(-time.Hour)})
+	dao.InsertOrUpdate(context.TODO(), &FileInfo{Filepath: "new.txt", LastAccess: now})
+	dao.InsertOrUpdate(context.TODO(), &FileInfo{Filepath: "newer.txt", LastAccess: now.Add(time.Minute)})
+
+	err := dao.SetPriority(context.TODO(), "old.txt", 1)
+	require.NoError(t, err)
+	err = dao.SetPriority(context.TODO(), "missing.txt", 1)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	list, err := dao.QueryOldest(context.TODO(), 3)
+	require.NoError(t, err)
+	require.Equal(t, "new.txt", list[0].Filepath)
+	require.Equal(t, "newer.txt", list[1].Filepath)
+	require.Equal(t, "old.txt", list[2].Filepath)
+}
+
+func TestMemoryQueryOldestAfter(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	now := time.Now()
+	for i, p := range []string{"d.txt", "b.txt", "a.txt", "c.txt", "e.txt"} {
+		dao.InsertOrUpdate(ctx, &FileInfo{Filepath: p, LastAccess: now.Add(time.Duration(len(p)-i) * time.Minute)})
+	}
+	// files sharing a last access are ordered by path, so no page boundary skips one of them
+	for _, p := range []string{"t2.txt", "t1.txt", "t3.txt"} {
+		dao.InsertOrUpdate(ctx, &FileInfo{Filepath: p, LastAccess: now})
+	}
+	dao.SetPriority(ctx, "e.txt", 1)
+
+	paths := []string{}
+	var cursor *FileInfo
+	for {
+		list, err := dao.QueryOldestAfter(ctx, cursor, 2)
+		require.NoError(t, err)
+		for i := range list {
+			paths = append(paths, list[i].Filepath)
+		}
+		if len(list) < 2 {
+			break
+		}
+		cursor = &list[len(list)-1]
+	}
+	// a higher priority goes last whatever its last access
+	require.Equal(t, []string{"t1.txt", "t2.txt", "t3.txt", "c.txt", "a.txt", "b.txt", "d.txt", "e.txt"}, paths)
+}
+
+func TestMemoryRename(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	lastAccess := time.Now().Add(-time.Hour)
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "a.txt", FileID: "1", Size: 10, LastAccess: lastAccess})
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "b.txt", Size: 5, LastAccess: time.Now()})
+
+	require.NoError(t, dao.Rename(ctx, "a.txt", "c.txt"))
+	list, err := dao.QueryOldest(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, FileInfo{Filepath: "c.txt", FileID: "1", Size: 10, LastAccess: lastAccess}, list[0])
+
+	require.ErrorIs(t, dao.Rename(ctx, "a.txt", "d.txt"), ErrNotFound)
+	require.ErrorIs(t, dao.Rename(ctx, "c.txt", "b.txt"), ErrFileExist)
+	list, err = dao.QueryOldest(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, "c.txt", list[0].Filepath)
+	require.Equal(t, "b.txt", list[1].Filepath)
+}
+
+func TestMemoryGet(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	fileInfo := FileInfo{Filepath: "a.txt", FileID: "1", Size: 10, MimeType: "text/plain", LastAccess: time.Now()}
+	dao.InsertOrUpdate(ctx, &fileInfo)
+
+	got, err := dao.Get(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, fileInfo, *got)
+	// the result is a copy
+	got.Size = 20
+	got, err = dao.Get(ctx, "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(10), got.Size)
+
+	_, err = dao.Get(ctx, "missing.txt")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryQueryByPrefix(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	for _, p := range []string{"a/b/c.txt", "a/b/d.txt", "a/e.txt", "ab/f.txt", "g.txt"} {
+		dao.InsertOrUpdate(ctx, &FileInfo{Filepath: p, LastAccess: time.Now()})
+	}
+	paths := func(prefix string) []string {
+		list, err := dao.QueryByPrefix(ctx, prefix)
+		require.NoError(t, err)
+		retVal := []string{}
+		for i := range list {
+			retVal = append(retVal, list[i].Filepath)
+		}
+		sort.Strings(retVal)
+		return retVal
+	}
+	require.Equal(t, []string{"a/b/c.txt", "a/b/d.txt"}, paths("a/b/"))
+	require.Equal(t, []string{"a/b/c.txt", "a/b/d.txt", "a/e.txt"}, paths("a/"))
+	require.Equal(t, []string{"a/b/c.txt", "a/b/d.txt", "a/e.txt", "ab/f.txt"}, paths("a"))
+	require.Equal(t, []string{"a/b/c.txt", "a/b/d.txt", "a/e.txt", "ab/f.txt", "g.txt"}, paths(""))
+	require.Empty(t, paths("missing/"))
+}
+
+func TestMemoryQueryExpired(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	cutoff := time.Now()
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "old.txt", LastAccess: cutoff.Add(-time.Hour)})
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "older.txt", LastAccess: cutoff.Add(-2 * time.Hour)})
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "cutoff.txt", LastAccess: cutoff})
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "new.txt", LastAccess: cutoff.Add(time.Hour)})
+
+	list, err := dao.QueryExpired(ctx, cutoff)
+	require.NoError(t, err)
+	paths := []string{}
+	for i := range list {
+		paths = append(paths, list[i].Filepath)
+	}
+	sort.Strings(paths)
+	require.Equal(t, []string{"old.txt", "older.txt"}, paths)
+
+	list, err = dao.QueryExpired(ctx, cutoff.Add(-3*time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, list)
+}
+
+func TestMemoryCount(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	count, err := dao.Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+		dao.InsertOrUpdate(ctx, &FileInfo{Filepath: p, LastAccess: time.Now()})
+	}
+	// an update is not another file
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "a.txt", Size: 1})
+	count, err = dao.Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	require.NoError(t, dao.Delete(ctx, "b.txt"))
+	count, err = dao.Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestMemoryCountByContentHash(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "a.txt", ContentHash: "h1"})
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "b.txt", ContentHash: "h1"})
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "c.txt", ContentHash: "h2"})
+
+	count, err := dao.CountByContentHash(ctx, "h1")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	count, err = dao.CountByContentHash(ctx, "missing")
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestMemoryLatestAccess(t *testing.T) {
+	dao := NewMemoryDao()
+	ctx := context.TODO()
+	latest, err := dao.LatestAccess(ctx)
+	require.NoError(t, err)
+	require.True(t, latest.IsZero())
+
+	now := time.Now()
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "a.txt", LastAccess: now.Add(-time.Hour)})
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "b.txt", LastAccess: now})
+	// an update keeps the LastAccess of the caller
+	dao.InsertOrUpdate(ctx, &FileInfo{Filepath: "a.txt", LastAccess: now.Add(time.Hour)})
+	latest, err = dao.LatestAccess(ctx)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Hour), latest)
+}
@@ -0,0 +1,25 @@
+package gdrive
+
+import "time"
+
+// Metrics receives the cache hits, misses, uploads and evictions of an instance, set it in Config.Metrics
+type Metrics interface {
+	IncHit()
+	IncMiss()
+	ObserveUpload(bytes int64, d time.Duration)
+	IncEviction(count int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncHit()                                    {}
+func (noopMetrics) IncMiss()                                   {}
+func (noopMetrics) ObserveUpload(bytes int64, d time.Duration) {}
+func (noopMetrics) IncEviction(count int)                      {}
+
+func (g *GDrive) metrics() Metrics {
+	if g.config.Metrics == nil {
+		return noopMetrics{}
+	}
+	return g.config.Metrics
+}
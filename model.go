@@ -1,17 +1,64 @@
 package gdrive
 
-import "time"
+import (
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
 
 type FileInsertInfo struct {
-	FileBytes []byte
-	Filepath  string
-	Replace   bool
+	FileBytes   []byte
+	Filepath    string
+	Replace     bool
+	Description string // searchable description of the file on google drive
+	StoredPath  string // filled by StoreFile with the path used in the cache
+
+	ExpectedVersion int64 // when replacing, fail with ErrConflict unless the google drive version matches
+	Priority        int   // eviction priority, lower is evicted first
 }
 
 type FileInfo struct {
-	FileID     string
-	LastAccess time.Time // time when the cache created
-	Filepath   string
-	Size       int64
-	MimeType   string
+	FileID      string
+	LastAccess  time.Time // time when the cache created
+	Filepath    string
+	Size        int64
+	MimeType    string
+	Description string
+	Version     int64  // google drive version of the file
+	Priority    int    // eviction priority, lower is evicted first
+	ContentHash string // sha256 of the content when Config.ContentAddressedLocal is set
+	Md5         string // md5 checksum of google drive, verified on download
+	StoredSize  int64  // bytes on disk and google drive when they differ from Size, like encrypted or compressed content
+
+	SourceMimeType string // google native mime type when the cached file was exported through Config.ExportMap
+	Placeholder    bool   // empty local file of TouchMissingPlaceholder, the path is missing on google drive
+}
+
+// DiskSize returns the bytes the file takes locally and on google drive, TotalSize and eviction count these
+func (f FileInfo) DiskSize() int64 {
+	if f.StoredSize > 0 {
+		return f.StoredSize
+	}
+	return f.Size
+}
+
+type FileResult struct {
+	Filepath string
+	Bytes    []byte
+	Err      error
+}
+
+// RemoteFile is a file or folder on google drive
+type RemoteFile struct {
+	ID           string
+	Name         string
+	MimeType     string
+	Size         int64
+	ModifiedTime time.Time
+	Parents      []string
+}
+
+func newRemoteFile(f *drive.File) *RemoteFile {
+	modified, _ := time.Parse(time.RFC3339, f.ModifiedTime)
+	return &RemoteFile{ID: f.Id, Name: f.Name, MimeType: f.MimeType, Size: f.Size, ModifiedTime: modified, Parents: f.Parents}
 }
@@ -0,0 +1,88 @@
+package gdrive
+
+import (
+	"context"
+	"math"
+)
+
+// EvictionPolicy chooses the files evicted when the cache is over Config.TotalMaxSize, set it in Config.EvictionPolicy.
+// Select returns candidates in eviction order covering at least bytesToFree when the dao holds enough.
+// Pinned files, files in the grace period and files being downloaded are skipped by the caller.
+type EvictionPolicy interface {
+	Select(ctx context.Context, dao Dao, bytesToFree int64) ([]FileInfo, error)
+}
+
+// CountPolicy is implemented by an EvictionPolicy able to select a number of files, used when the cache is over
+// Config.MaxFileCount. A policy without it is asked to Select every file and its first candidates are evicted.
+type CountPolicy interface {
+	SelectCount(ctx context.Context, dao Dao, files int) ([]FileInfo, error)
+}
+
+// LRUPolicy evicts lower priorities first and the least recently accessed files first within a priority.
+// It is the default policy.
+type LRUPolicy struct {
+	BatchSize int // files fetched per dao query, default 10
+}
+
+// Select pages through the dao with QueryOldestAfter so every query only reads the next batch
+func (p *LRUPolicy) Select(ctx context.Context, dao Dao, bytesToFree int64) ([]FileInfo, error) {
+	return p.selectUntil(ctx, dao, func(_ []FileInfo, total int64) bool { return total >= bytesToFree })
+}
+
+// SelectCount returns the first files in the order of Select
+func (p *LRUPolicy) SelectCount(ctx context.Context, dao Dao, files int) ([]FileInfo, error) {
+	if files <= 0 {
+		return []FileInfo{}, nil
+	}
+	return p.selectUntil(ctx, dao, func(list []FileInfo, _ int64) bool { return len(list) >= files })
+}
+
+// selectUntil pages through the files in eviction order until enough reports the selected files are enough
+func (p *LRUPolicy) selectUntil(ctx context.Context, dao Dao, enough func(list []FileInfo, total int64) bool) ([]FileInfo, error) {
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultEvictionBatchSize
+	}
+	retVal := []FileInfo{}
+	var cursor *FileInfo
+	var total int64
+	for {
+		list, err := dao.QueryOldestAfter(ctx, cursor, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list {
+			retVal = append(retVal, list[i])
+			total += list[i].DiskSize()
+			if enough(retVal, total) {
+				return retVal, nil
+			}
+		}
+		if len(list) < batchSize {
+			return retVal, nil
+		}
+		cursor = &list[len(list)-1]
+	}
+}
+
+// selectCount returns up to files candidates of the policy for the file count limit
+func selectCount(ctx context.Context, policy EvictionPolicy, dao Dao, files int) ([]FileInfo, error) {
+	if p, ok := policy.(CountPolicy); ok {
+		return p.SelectCount(ctx, dao, files)
+	}
+	list, err := policy.Select(ctx, dao, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > files {
+		list = list[:files]
+	}
+	return list, nil
+}
+
+func (g *GDrive) evictionPolicy() EvictionPolicy {
+	if g.config.EvictionPolicy != nil {
+		return g.config.EvictionPolicy
+	}
+	return &LRUPolicy{BatchSize: g.evictionBatchSize()}
+}
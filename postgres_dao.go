@@ -0,0 +1,244 @@
+package gdrive
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Postgres stores the cache metadata in a postgres table so several instances can share it.
+// The caller opens the database with the driver of its choice, CreateTable creates the table when it is missing.
+type Postgres struct {
+	db    *sql.DB
+	table string
+	index string // index of the eviction order, created next to the table
+	// index of the last access, for the expired files
+	accessIndex string
+	hashIndex   string // index of the content hash, for the blobs still referenced
+}
+
+func NewPostgresDao(db *sql.DB, table string) *Postgres {
+	name := table[strings.LastIndex(table, ".")+1:]
+	return &Postgres{db: db, table: quoteIdentifier(table), index: quoteIdentifier(name + "_eviction"),
+		accessIndex: quoteIdentifier(name + "_last_access"), hashIndex: quoteIdentifier(name + "_content_hash")}
+}
+
+// quoteIdentifier quotes every part of a possibly schema qualified name
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i := range parts {
+		parts[i] = `"` + strings.ReplaceAll(parts[i], `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+const postgresColumns = "filepath, file_id, last_access, size, mime_type, description, version, priority, content_hash, md5, source_mime_type, stored_size, placeholder"
+
+func (p *Postgres) CreateTable(ctx context.Context) error {
+	_, err := p.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		filepath text PRIMARY KEY,
+		file_id text NOT NULL DEFAULT '',
+		last_access timestamptz NOT NULL,
+		size bigint NOT NULL DEFAULT 0,
+		mime_type text NOT NULL DEFAULT '',
+		description text NOT NULL DEFAULT '',
+		version bigint NOT NULL DEFAULT 0,
+		priority integer NOT NULL DEFAULT 0,
+		content_hash text NOT NULL DEFAULT '',
+		md5 text NOT NULL DEFAULT '',
+		source_mime_type text NOT NULL DEFAULT '',
+		stored_size bigint NOT NULL DEFAULT 0,
+		placeholder boolean NOT NULL DEFAULT false
+	)`, p.table))
+	if err != nil {
+		return err
+	}
+	// tables created before the columns existed
+	for _, column := range []string{"stored_size bigint NOT NULL DEFAULT 0", "placeholder boolean NOT NULL DEFAULT false"} {
+		_, err = p.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", p.table, column))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = p.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (priority, last_access, filepath)", p.index, p.table))
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (last_access)", p.accessIndex, p.table))
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (content_hash)", p.hashIndex, p.table))
+	return err
+}
+
+func (p *Postgres) InsertOrUpdate(ctx context.Context, fileInfo *FileInfo) error {
+	_, err := p.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (%s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (filepath) DO UPDATE SET file_id = EXCLUDED.file_id, last_access = EXCLUDED.last_access,
+		size = EXCLUDED.size, mime_type = EXCLUDED.mime_type, description = EXCLUDED.description,
+		version = EXCLUDED.version, priority = EXCLUDED.priority, content_hash = EXCLUDED.content_hash,
+		md5 = EXCLUDED.md5, source_mime_type = EXCLUDED.source_mime_type, stored_size = EXCLUDED.stored_size,
+		placeholder = EXCLUDED.placeholder`, p.table, postgresColumns),
+		fileInfo.Filepath, fileInfo.FileID, fileInfo.LastAccess, fileInfo.Size, fileInfo.MimeType, fileInfo.Description,
+		fileInfo.Version, fileInfo.Priority, fileInfo.ContentHash, fileInfo.Md5, fileInfo.SourceMimeType, fileInfo.StoredSize,
+		fileInfo.Placeholder)
+	return err
+}
+
+func (p *Postgres) Touch(ctx context.Context, filepathName string, date time.Time) error {
+	_, err := p.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET last_access = $1 WHERE filepath = $2", p.table), date, filepathName)
+	return err
+}
+
+func (p *Postgres) SetPriority(ctx context.Context, filepathName string, priority int) error {
+	res, err := p.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET priority = $1 WHERE filepath = $2", p.table), priority, filepathName)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (p *Postgres) Delete(ctx context.Context, filepathName string) error {
+	res, err := p.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE filepath = $1", p.table), filepathName)
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+func (p *Postgres) Rename(ctx context.Context, oldPath, newPath string) error {
+	res, err := p.db.ExecContext(ctx, fmt.Sprintf(`UPDATE %[1]s SET filepath = $2 WHERE filepath = $1
+		AND NOT EXISTS (SELECT 1 FROM %[1]s WHERE filepath = $2)`, p.table), oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	err = requireAffected(res)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	var exists bool
+	err = p.db.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE filepath = $1)", p.table), newPath).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrFileExist
+	}
+	return ErrNotFound
+}
+
+// requireAffected returns ErrNotFound when the statement changed no row
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *Postgres) TotalSize(ctx context.Context) (int64, error) {
+	var total int64
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(SUM(CASE WHEN stored_size > 0 THEN stored_size ELSE size END), 0) FROM %s", p.table)).Scan(&total)
+	return total, err
+}
+
+func (p *Postgres) LatestAccess(ctx context.Context) (time.Time, error) {
+	var latest sql.NullTime
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(last_access) FROM %s", p.table)).Scan(&latest)
+	return latest.Time, err
+}
+
+func (p *Postgres) Count(ctx context.Context) (int, error) {
+	var count int
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", p.table)).Scan(&count)
+	return count, err
+}
+
+func (p *Postgres) CountByContentHash(ctx context.Context, hash string) (int, error) {
+	var count int
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE content_hash = $1", p.table), hash).Scan(&count)
+	return count, err
+}
+
+func (p *Postgres) SizeByMimeType(ctx context.Context) (map[string]int64, error) {
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf("SELECT mime_type, SUM(size) FROM %s GROUP BY mime_type", p.table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	retVal := map[string]int64{}
+	for rows.Next() {
+		var mimeType string
+		var size int64
+		err = rows.Scan(&mimeType, &size)
+		if err != nil {
+			return nil, err
+		}
+		retVal[mimeType] = size
+	}
+	return retVal, rows.Err()
+}
+
+func (p *Postgres) Get(ctx context.Context, filepathName string) (*FileInfo, error) {
+	list, err := p.query(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE filepath = $1", postgresColumns, p.table), filepathName)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrNotFound
+	}
+	return &list[0], nil
+}
+
+func (p *Postgres) QueryOldest(ctx context.Context, limit int) ([]FileInfo, error) {
+	return p.query(ctx, fmt.Sprintf("SELECT %s FROM %s ORDER BY priority, last_access, filepath LIMIT $1",
+		postgresColumns, p.table), limit)
+}
+
+// QueryOldestAfter pages with a (priority, last_access, filepath) keyset served by the eviction index
+func (p *Postgres) QueryOldestAfter(ctx context.Context, cursor *FileInfo, limit int) ([]FileInfo, error) {
+	if cursor == nil {
+		return p.query(ctx, fmt.Sprintf("SELECT %s FROM %s ORDER BY priority, last_access, filepath LIMIT $1",
+			postgresColumns, p.table), limit)
+	}
+	return p.query(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE (priority, last_access, filepath) > ($1, $2, $3)
+		ORDER BY priority, last_access, filepath LIMIT $4`, postgresColumns, p.table),
+		cursor.Priority, cursor.LastAccess, cursor.Filepath, limit)
+}
+
+func (p *Postgres) QueryExpired(ctx context.Context, before time.Time) ([]FileInfo, error) {
+	return p.query(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE last_access < $1", postgresColumns, p.table), before)
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (p *Postgres) QueryByPrefix(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return p.query(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE filepath LIKE $1 ESCAPE '\'`, postgresColumns, p.table),
+		likeEscaper.Replace(prefix)+"%")
+}
+
+func (p *Postgres) query(ctx context.Context, query string, args ...interface{}) ([]FileInfo, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	retVal := []FileInfo{}
+	for rows.Next() {
+		var f FileInfo
+		err = rows.Scan(&f.Filepath, &f.FileID, &f.LastAccess, &f.Size, &f.MimeType, &f.Description, &f.Version,
+			&f.Priority, &f.ContentHash, &f.Md5, &f.SourceMimeType, &f.StoredSize, &f.Placeholder)
+		if err != nil {
+			return nil, err
+		}
+		retVal = append(retVal, f)
+	}
+	return retVal, rows.Err()
+}
@@ -0,0 +1,67 @@
+package gdrive
+
+import (
+	"io"
+	"sync"
+)
+
+// ProgressFunc receives the transferred bytes of an upload or download, total is -1 when the size is unknown.
+// It is called from the goroutine doing the transfer and never after the transfer completed or failed.
+type ProgressFunc func(filepath string, bytesDone, bytesTotal int64)
+
+// progressReader reports every read to Config.ProgressFunc. A rewound reader, like a retried upload,
+// only reports again once it passes the bytes already reported, so the progress never goes back.
+type progressReader struct {
+	r        io.Reader
+	fn       ProgressFunc
+	path     string
+	total    int64
+	mut      sync.Mutex
+	pos      int64
+	reported int64
+	finished bool
+}
+
+type progressReadSeeker struct {
+	*progressReader
+}
+
+// withProgress wraps the reader when Config.ProgressFunc is set, a seekable reader stays seekable
+func (g *GDrive) withProgress(filePathName string, r io.Reader, total int64) io.Reader {
+	if g.config.ProgressFunc == nil {
+		return r
+	}
+	p := &progressReader{r: r, fn: g.config.ProgressFunc, path: filePathName, total: total}
+	if _, ok := r.(io.Seeker); ok {
+		return progressReadSeeker{p}
+	}
+	return p
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.pos += int64(n)
+	if p.pos > p.reported && !p.finished {
+		p.reported = p.pos
+		p.fn(p.path, p.pos, p.total)
+	}
+	if err != nil {
+		p.finished = true
+	}
+	return n, err
+}
+
+func (p progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.r.(io.Seeker).Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.pos = pos
+	// a rewind for another attempt may read until the end again
+	p.finished = false
+	return pos, nil
+}
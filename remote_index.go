@@ -0,0 +1,74 @@
+package gdrive
+
+import (
+	"context"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// RefreshRemoteIndex lists the parent folder once and keeps the name to file map, so following lookups of
+// cached paths on google drive are answered without api calls until InvalidateRemoteIndex is called.
+// Files changed by this instance are looked up again, changes made elsewhere are only seen after a refresh.
+func (g *GDrive) RefreshRemoteIndex(ctx context.Context) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	files, err := g.listRemote(ctx)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]*drive.File, len(files))
+	for _, entry := range files {
+		if _, ok := index[entry.Path]; !ok {
+			index[entry.Path] = entry.File
+		}
+	}
+	g.mut.Lock()
+	g.remoteIndex = index
+	g.mut.Unlock()
+	return nil
+}
+
+// InvalidateRemoteIndex drops the index of RefreshRemoteIndex, lookups query google drive again
+func (g *GDrive) InvalidateRemoteIndex() {
+	g.mut.Lock()
+	g.remoteIndex = nil
+	g.mut.Unlock()
+}
+
+// indexedRemote returns the indexed file of the path, known is false when google drive must be asked
+func (g *GDrive) indexedRemote(filePathName string) (driveFile *drive.File, known bool) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.remoteIndex == nil {
+		return nil, false
+	}
+	driveFile, ok := g.remoteIndex[filePathName]
+	if !ok {
+		// the listing did not contain it
+		return nil, true
+	}
+	return driveFile, driveFile != nil
+}
+
+// setIndexedRemote records a lookup result in the index when it is loaded
+func (g *GDrive) setIndexedRemote(filePathName string, driveFile *drive.File) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.remoteIndex != nil {
+		if driveFile == nil {
+			delete(g.remoteIndex, filePathName)
+			return
+		}
+		g.remoteIndex[filePathName] = driveFile
+	}
+}
+
+// forgetRemote marks the indexed file as changed, the next lookup asks google drive again
+func (g *GDrive) forgetRemote(filepathName string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.remoteIndex != nil {
+		g.remoteIndex[filepathName] = nil
+	}
+}
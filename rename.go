@@ -0,0 +1,93 @@
+package gdrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Rename moves the cached file to newPath, keeping its google drive file id and last access.
+// A file whose local copy was evicted is only renamed on google drive. An existing newPath fails with ErrFileExist.
+func (g *GDrive) Rename(ctx context.Context, oldPath, newPath string) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	// both paths are locked in the same order by every rename, so crossing renames never deadlock
+	first, second := oldPath, newPath
+	if second < first {
+		first, second = second, first
+	}
+	unlockFirst := g.pathLocks.lock(first)
+	defer unlockFirst()
+	unlockSecond := g.pathLocks.lock(second)
+	defer unlockSecond()
+
+	if g.localFileExist(newPath) || g.getFileInCloud(ctx, newPath) != nil {
+		return fmt.Errorf("%s: %w", newPath, ErrFileExist)
+	}
+	driveFile := g.getFileInCloud(ctx, oldPath)
+	if driveFile == nil {
+		return fmt.Errorf("%s: %w", oldPath, ErrNotFound)
+	}
+
+	err := g.renameRemote(ctx, driveFile, oldPath, newPath)
+	if err != nil {
+		return err
+	}
+
+	if g.localFileExist(oldPath) {
+		localPath := g.localFullPath(newPath)
+		err = g.mkdirAll(filepath.Dir(localPath))
+		if err != nil {
+			return err
+		}
+		err = os.Rename(g.localFullPath(oldPath), localPath)
+		if err != nil {
+			return err
+		}
+	}
+	if g.config.SegmentFolder != "" {
+		err = os.Rename(g.segmentDir(oldPath), g.segmentDir(newPath))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if g.dao != nil {
+		// a file missing from the dao has nothing to keep
+		err = g.dao.Rename(ctx, oldPath, newPath)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameRemote gives the google drive file the name of newPath, moving it between folders with native folders
+func (g *GDrive) renameRemote(ctx context.Context, driveFile *drive.File, oldPath, newPath string) error {
+	oldFolderID, _, err := g.remoteLocation(ctx, oldPath, false)
+	if err != nil {
+		return err
+	}
+	folderID, name, err := g.remoteLocation(ctx, newPath, true)
+	if err != nil {
+		return err
+	}
+	defer g.forgetRemote(oldPath)
+	defer g.forgetRemote(newPath)
+	return g.withRetry(ctx, func() error {
+		call := g.filesUpdate(driveFile.Id, &drive.File{Name: name})
+		if folderID != oldFolderID {
+			call = call.AddParents(folderID).RemoveParents(oldFolderID)
+		}
+		_, err := call.Fields("id").Context(ctx).Do()
+		return err
+	})
+}
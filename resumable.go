@@ -0,0 +1,379 @@
+package gdrive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const defaultUploadChunkSize = 8 * 1024 * 1024 // must be a multiple of 256 KiB
+
+// uploadSession is an in-progress resumable upload, persisted to Config.UploadStateFile
+type uploadSession struct {
+	Filepath   string `json:"filepath"`
+	SessionURI string `json:"sessionUri"`
+	Size       int64  `json:"size"`
+	Offset     int64  `json:"offset"`
+	Priority   int    `json:"priority,omitempty"` // priority of the stored file, recorded in the dao once uploaded
+}
+
+// ResumePendingUploads continues every resumable upload recorded in Config.UploadStateFile by a previous process.
+// The content is read again from the local cache file.
+func (g *GDrive) ResumePendingUploads(ctx context.Context) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	err := g.loadSessions()
+	if err != nil {
+		return err
+	}
+	g.mut.Lock()
+	sessions := make([]uploadSession, 0, len(g.sessions))
+	for _, session := range g.sessions {
+		sessions = append(sessions, *session)
+	}
+	g.mut.Unlock()
+
+	errs := []error{}
+	for i := range sessions {
+		err := g.resumeSession(ctx, &sessions[i])
+		if err != nil {
+			g.logger().Errorf("unable to resume upload of %s: %v", sessions[i].Filepath, err)
+			errs = append(errs, fmt.Errorf("%s: %w", sessions[i].Filepath, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (g *GDrive) resumeSession(ctx context.Context, session *uploadSession) error {
+	f, err := os.Open(g.localFullPath(session.Filepath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// nothing left to upload
+			return g.removeSession(session.Filepath)
+		}
+		return err
+	}
+	defer f.Close()
+	defer g.forgetRemote(session.Filepath)
+
+	res, offset, err := g.queryResumableOffset(ctx, session)
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		session.Offset = offset
+		res, err = g.continueResumable(ctx, session, f)
+		if err != nil {
+			return err
+		}
+	}
+	if g.dao != nil {
+		fileInfo, err := g.uploadedFileInfo(session.Filepath, res, session.Size)
+		if err != nil {
+			return err
+		}
+		fileInfo.Priority = session.Priority
+		g.dao.InsertOrUpdate(ctx, fileInfo)
+	}
+	return g.removeSession(session.Filepath)
+}
+
+// uploadedFileInfo is the dao row of a cached file uploaded from the local cache, stored is its size on disk
+func (g *GDrive) uploadedFileInfo(rel string, res *drive.File, stored int64) (*FileInfo, error) {
+	contentSize, err := g.localContentSize(rel, stored)
+	if err != nil {
+		return nil, err
+	}
+	contentHash, err := g.localContentHash(rel)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{FileID: res.Id, LastAccess: g.now(), Filepath: rel, Size: contentSize,
+		StoredSize: storedSize(contentSize, stored), MimeType: res.MimeType, Description: res.Description,
+		Version: res.Version, ContentHash: contentHash, Md5: res.Md5Checksum}, nil
+}
+
+func (g *GDrive) useResumable(size int64) bool {
+	return g.config.ResumableThreshold > 0 && size >= g.config.ResumableThreshold
+}
+
+func (g *GDrive) uploadChunkSize() int64 {
+	if g.config.UploadChunkSize > 0 {
+		return g.config.UploadChunkSize
+	}
+	return defaultUploadChunkSize
+}
+
+// uploadResumable uploads the content using a resumable session which is recorded until the upload completes.
+// The expected version of the options is not checked.
+func (g *GDrive) uploadResumable(ctx context.Context, filepathName string, content io.ReaderAt, size int64, opts uploadOptions) (*drive.File, error) {
+	driveFile := g.getFileInCloud(ctx, filepathName)
+	if driveFile != nil && !opts.replace {
+		return driveFile, nil
+	}
+	defer g.forgetRemote(filepathName)
+	mimeType := g.mimeTypeFor(filepathName, readHeadAt(content))
+	sessionURI, err := g.startResumableSession(ctx, filepathName, size, driveFile, opts.description, mimeType)
+	if isStorageFull(err) && g.config.EvictRemoteOnFull && g.evictRemote(ctx, filepathName, size) > 0 {
+		sessionURI, err = g.startResumableSession(ctx, filepathName, size, driveFile, opts.description, mimeType)
+	}
+	if isStorageFull(err) {
+		return nil, fmt.Errorf("%s: %w", filepathName, ErrStorageFull)
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &uploadSession{Filepath: filepathName, SessionURI: sessionURI, Size: size, Priority: opts.priority}
+	err = g.saveSession(session)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	res, err := g.continueResumable(ctx, session, content)
+	if err != nil {
+		return nil, err
+	}
+	g.metrics().ObserveUpload(size, time.Since(start))
+	if res.MimeType == "" {
+		res.MimeType = mimeType
+	}
+	return res, g.removeSession(filepathName)
+}
+
+func (g *GDrive) startResumableSession(ctx context.Context, filepathName string, size int64, existing *drive.File, description, mimeType string) (string, error) {
+	method := http.MethodPost
+	urls := googleapi.ResolveRelative(g.service().BasePath, "/upload/drive/v3/files")
+	folderID, name, err := g.remoteLocation(ctx, filepathName, existing == nil)
+	if err != nil {
+		return "", err
+	}
+	meta := &drive.File{Name: name, Description: description, MimeType: mimeType}
+	if existing != nil {
+		method = http.MethodPatch
+		urls = googleapi.ResolveRelative(g.service().BasePath, "/upload/drive/v3/files/"+existing.Id)
+	} else {
+		meta.Parents = []string{folderID}
+	}
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	urls += "?uploadType=resumable&fields=id,name,mimeType,description,version,md5Checksum"
+	if g.config.DriveID != "" {
+		urls += "&supportsAllDrives=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, urls, strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	if mimeType != "" {
+		req.Header.Set("X-Upload-Content-Type", mimeType)
+	}
+	resp, err := g.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	err = googleapi.CheckResponse(resp)
+	if err != nil {
+		return "", err
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("resumable session location not returned")
+	}
+	return location, nil
+}
+
+// continueResumable sends the content from session.Offset in chunks until google drive reports the file complete.
+// A failed chunk is retried from the offset google drive committed, so a dropped connection does not resend the file.
+func (g *GDrive) continueResumable(ctx context.Context, session *uploadSession, content io.ReaderAt) (*drive.File, error) {
+	chunkSize := g.uploadChunkSize()
+	for {
+		var res *drive.File
+		var offset int64
+		failed := false
+		err := g.withRetryIf(ctx, isResumable, func() (err error) {
+			if failed {
+				res, offset, err = g.queryResumableOffset(ctx, session)
+				if err != nil || res != nil {
+					return err
+				}
+				session.Offset = offset
+			}
+			end := session.Offset + chunkSize
+			if end > session.Size {
+				end = session.Size
+			}
+			contentRange := fmt.Sprintf("bytes */%d", session.Size)
+			if end > session.Offset {
+				contentRange = fmt.Sprintf("bytes %d-%d/%d", session.Offset, end-1, session.Size)
+			}
+			res, offset, err = g.putResumable(ctx, session, io.NewSectionReader(content, session.Offset, end-session.Offset), contentRange)
+			failed = err != nil
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if res != nil {
+			g.resumableProgress(session, session.Size)
+			return res, nil
+		}
+		session.Offset = offset
+		g.resumableProgress(session, offset)
+		err = g.saveSession(session)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resumableProgress reports the committed bytes of the session to Config.ProgressFunc
+func (g *GDrive) resumableProgress(session *uploadSession, committed int64) {
+	if g.config.ProgressFunc != nil && committed > 0 {
+		g.config.ProgressFunc(session.Filepath, committed, session.Size)
+	}
+}
+
+// queryResumableOffset asks google drive how many bytes of the session were committed
+func (g *GDrive) queryResumableOffset(ctx context.Context, session *uploadSession) (*drive.File, int64, error) {
+	return g.putResumable(ctx, session, http.NoBody, fmt.Sprintf("bytes */%d", session.Size))
+}
+
+// putResumable returns the file when the upload is complete or the committed offset otherwise
+func (g *GDrive) putResumable(ctx context.Context, session *uploadSession, body io.Reader, contentRange string) (*drive.File, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session.SessionURI, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := g.client().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPermanentRedirect {
+		// 308 resume incomplete, Range holds the committed bytes
+		var last int64 = -1
+		if r := resp.Header.Get("Range"); r != "" {
+			_, err := fmt.Sscanf(r, "bytes=0-%d", &last)
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid range header %q: %w", r, err)
+			}
+		}
+		return nil, last + 1, nil
+	}
+	err = googleapi.CheckResponse(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := &drive.File{}
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, session.Size, nil
+}
+
+func (g *GDrive) loadSessions() error {
+	g.sessionsOnce.Do(func() {
+		g.mut.Lock()
+		defer g.mut.Unlock()
+		if g.sessions == nil {
+			g.sessions = map[string]*uploadSession{}
+		}
+		if g.config.UploadStateFile == "" {
+			return
+		}
+		b, err := os.ReadFile(g.config.UploadStateFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				g.sessionsErr = err
+			}
+			return
+		}
+		stored := []uploadSession{}
+		err = json.Unmarshal(b, &stored)
+		if err != nil {
+			g.sessionsErr = err
+			return
+		}
+		for i := range stored {
+			if _, ok := g.sessions[stored[i].Filepath]; !ok {
+				g.sessions[stored[i].Filepath] = &stored[i]
+			}
+		}
+	})
+	return g.sessionsErr
+}
+
+// hasSession reports whether an upload of the path is pending
+func (g *GDrive) hasSession(filepathName string) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	_, ok := g.sessions[filepathName]
+	return ok
+}
+
+func (g *GDrive) saveSession(session *uploadSession) error {
+	err := g.loadSessions()
+	if err != nil {
+		return err
+	}
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	copied := *session
+	g.sessions[session.Filepath] = &copied
+	return g.writeSessions()
+}
+
+func (g *GDrive) removeSession(filepathName string) error {
+	err := g.loadSessions()
+	if err != nil {
+		return err
+	}
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	delete(g.sessions, filepathName)
+	return g.writeSessions()
+}
+
+// writeSessions must be called with g.mut held
+func (g *GDrive) writeSessions() error {
+	if g.config.UploadStateFile == "" {
+		return nil
+	}
+	stored := make([]uploadSession, 0, len(g.sessions))
+	for _, session := range g.sessions {
+		stored = append(stored, *session)
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	tmp := g.config.UploadStateFile + ".tmp"
+	err = g.mkdirAll(filepath.Dir(tmp))
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.config.UploadStateFile)
+}
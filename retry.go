@@ -0,0 +1,163 @@
+package gdrive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultMaxRetries = 3
+	retryBaseDelay    = 500 * time.Millisecond
+)
+
+// withRetry calls fn until it succeeds, returns a non retryable error or the retries are exhausted.
+// Rate limited responses wait for the Retry-After duration sent by google drive instead of the backoff.
+func (g *GDrive) withRetry(ctx context.Context, fn func() error) error {
+	return g.withRetryIf(ctx, isRetryable, fn)
+}
+
+// withRetryIf is withRetry with its own test of retryable errors
+func (g *GDrive) withRetryIf(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	backoff := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= g.maxRetries() || !retryable(err) {
+			return err
+		}
+		delay := backoff
+		if retryAfter, ok := retryAfterDelay(err); ok {
+			delay = retryAfter
+		}
+		backoff *= 2
+		g.logger().Debugf("retrying google drive call in %s: %v", delay, err)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// withRetryCreate is withRetryReader for creates, a nil reader creates without content. A server error may come after
+// google drive created the file, so before retrying it find looks the file up and an existing file is returned
+// instead of creating a duplicate. Rejected requests like rate limits are simply retried.
+func (g *GDrive) withRetryCreate(ctx context.Context, reader io.Reader, find, create func() (*drive.File, error)) (*drive.File, error) {
+	var res *drive.File
+	var createErr error
+	attempt := func() error {
+		if isServerError(createErr) {
+			existing, err := find()
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				res = existing
+				return nil
+			}
+		}
+		res, createErr = create()
+		return createErr
+	}
+	var err error
+	if reader == nil {
+		err = g.withRetry(ctx, attempt)
+	} else {
+		err = g.withRetryReader(ctx, reader, attempt)
+	}
+	return res, err
+}
+
+// withRetryReader is withRetry for uploads, the reader is rewound before each attempt.
+// Readers that can not be rewound are only tried once.
+func (g *GDrive) withRetryReader(ctx context.Context, reader io.Reader, fn func() error) error {
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return fn()
+	}
+	return g.withRetry(ctx, func() error {
+		_, err := seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+func isServerError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code >= http.StatusInternalServerError
+}
+
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError {
+		return true
+	}
+	if apiErr.Code == http.StatusForbidden {
+		for _, item := range apiErr.Errors {
+			if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isResumable reports whether a resumable upload can continue after the error, besides the retryable google drive
+// errors a dropped connection is resumed from the committed offset
+func isResumable(err error) bool {
+	if isRetryable(err) {
+		return true
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// isStorageFull reports whether google drive rejected the upload because the storage quota is exceeded
+func isStorageFull(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "storageQuotaExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+func retryAfterDelay(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0, false
+	}
+	value := apiErr.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
@@ -0,0 +1,68 @@
+package gdrive
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryAfterDelay(t *testing.T) {
+	err := &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"7"}}}
+	delay, ok := retryAfterDelay(err)
+	require.True(t, ok)
+	require.Equal(t, 7*time.Second, delay)
+
+	_, ok = retryAfterDelay(&googleapi.Error{Code: http.StatusTooManyRequests})
+	require.False(t, ok)
+}
+
+func TestWithRetryHonorsRetryAfter(t *testing.T) {
+	g := &GDrive{config: &Config{MaxRetries: 2}}
+	calls := 0
+	start := time.Now()
+	err := g.withRetry(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"0"}}}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+	// the default backoff would have waited retryBaseDelay
+	require.Less(t, time.Since(start), retryBaseDelay)
+
+	calls = 0
+	err = g.withRetry(context.Background(), func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusNotFound}
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetryCreateAfterServerError(t *testing.T) {
+	instance, fake := newFakeInstance(t, &Config{UseNativeFolders: true}, NewMemoryDao())
+	ctx := context.TODO()
+	creates := fake.callCount("create")
+	// google drive created the folder and the file but both answers were lost
+	fake.lostCreates = 2
+	require.NoError(t, instance.StoreFile(ctx, &FileInsertInfo{Filepath: "dir/a.txt", FileBytes: []byte("a")}))
+	require.Equal(t, creates+2, fake.callCount("create"))
+
+	fake.mut.Lock()
+	names := map[string]int{}
+	for _, file := range fake.files {
+		names[file.meta.Name]++
+	}
+	fake.mut.Unlock()
+	require.Equal(t, 1, names["dir"])
+	require.Equal(t, 1, names["a.txt"])
+	b, err := instance.ReadFile(ctx, "dir/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), b)
+}
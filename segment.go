@@ -0,0 +1,427 @@
+package gdrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// segment is a cached byte range of a remote file, stored as <offset>-<length>.part in the file's segment folder
+type segment struct {
+	Offset int64
+	Length int64
+}
+
+func (s segment) end() int64 {
+	return s.Offset + s.Length
+}
+
+// DownloadRange returns length bytes of the file starting at offset.
+// A fully cached file is read locally. Otherwise, when Config.SegmentFolder is set, the fetched ranges are cached
+// as segments and later reads only download the gaps between cached segments.
+// Encrypted content can not be read in ranges, the whole file is read and sliced.
+func (g *GDrive) DownloadRange(ctx context.Context, filePathName string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range %d+%d: %w", offset, length, ErrInvalidRange)
+	}
+	if g.encodesContent() {
+		b, err := g.readFile(ctx, filePathName)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= int64(len(b)) {
+			return nil, fmt.Errorf("offset %d is beyond the end of the file: %w", offset, ErrInvalidRange)
+		}
+		length = clampLength(offset, length, int64(len(b)))
+		return b[offset : offset+length], nil
+	}
+	f, err := os.Open(g.localFullPath(filePathName))
+	if err == nil {
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if offset >= stat.Size() {
+			return nil, fmt.Errorf("offset %d is beyond the end of the file: %w", offset, ErrInvalidRange)
+		}
+		// the buffer is never larger than the rest of the file
+		b := make([]byte, clampLength(offset, length, stat.Size()))
+		n, err := f.ReadAt(b, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("offset %d is beyond the end of the file: %w", offset, ErrInvalidRange)
+		}
+		return b[:n], nil
+	}
+
+	if g.service() == nil {
+		return nil, ErrNotAuthenticated
+	}
+	driveFile := g.getFileInCloud(ctx, filePathName)
+	if driveFile == nil {
+		return nil, fmt.Errorf("%s: %w", filePathName, ErrNotFound)
+	}
+	if driveFile.Size > 0 {
+		if offset >= driveFile.Size {
+			return nil, fmt.Errorf("offset %d is beyond the end of the file: %w", offset, ErrInvalidRange)
+		}
+		length = clampLength(offset, length, driveFile.Size)
+	} else if length > math.MaxInt64-offset {
+		// the size is unknown, the range only must not overflow
+		length = math.MaxInt64 - offset
+	}
+	if g.config.SegmentFolder == "" {
+		return g.downloadRemoteRange(ctx, driveFile, offset, length)
+	}
+
+	// segments are only removed under the path lock
+	unlock := g.pathLocks.lock(filePathName)
+	defer unlock()
+	segments, err := g.segments(filePathName)
+	if err != nil {
+		return nil, err
+	}
+	retVal := []byte{}
+	if driveFile.Size > 0 {
+		retVal = make([]byte, 0, length)
+	}
+	pos, end := offset, offset+length
+	for pos < end {
+		covering := -1
+		next := end
+		for i := range segments {
+			if segments[i].Offset <= pos && pos < segments[i].end() {
+				covering = i
+				break
+			}
+			if segments[i].Offset > pos && segments[i].Offset < next {
+				next = segments[i].Offset
+			}
+		}
+		if covering >= 0 {
+			seg := segments[covering]
+			readEnd := seg.end()
+			if readEnd > end {
+				readEnd = end
+			}
+			b, err := g.readSegment(filePathName, seg, pos-seg.Offset, readEnd-pos)
+			if err != nil {
+				return nil, err
+			}
+			retVal = append(retVal, b...)
+			pos = readEnd
+			continue
+		}
+		// fetch the gap until the next cached segment
+		b, err := g.downloadRemoteRange(ctx, driveFile, pos, next-pos)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			break
+		}
+		seg := segment{Offset: pos, Length: int64(len(b))}
+		err = g.writeSegment(filePathName, seg, b)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+		retVal = append(retVal, b...)
+		pos = seg.end()
+	}
+	return retVal, nil
+}
+
+// ReadRange returns exactly length bytes of the file starting at offset, a range reaching past the end of the file
+// fails with ErrInvalidRange. A cached file is read locally, otherwise only the range is downloaded as with DownloadRange.
+func (g *GDrive) ReadRange(ctx context.Context, filePathName string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range %d+%d: %w", offset, length, ErrInvalidRange)
+	}
+	// the range is checked before any buffer of its length is allocated
+	if size, known := g.knownSize(ctx, filePathName); known && length > size-offset {
+		return nil, fmt.Errorf("range %d+%d ends after %d bytes: %w", offset, length, size, ErrInvalidRange)
+	}
+	b, err := g.DownloadRange(ctx, filePathName, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) < length {
+		return nil, fmt.Errorf("range %d+%d ends after %d bytes: %w", offset, length, offset+int64(len(b)), ErrInvalidRange)
+	}
+	return b, nil
+}
+
+// knownSize returns the content size of the file from the local cache, the dao or google drive
+func (g *GDrive) knownSize(ctx context.Context, filePathName string) (int64, bool) {
+	// the local and remote sizes are of the stored bytes, encoded content only has its size in the dao
+	if !g.encodesContent() {
+		if stat, err := os.Stat(g.localFullPath(filePathName)); err == nil {
+			return stat.Size(), true
+		}
+	}
+	if g.dao != nil {
+		if fileInfo, err := g.dao.Get(ctx, filePathName); err == nil {
+			return fileInfo.Size, true
+		}
+	}
+	if !g.encodesContent() {
+		if driveFile := g.getFileInCloud(ctx, filePathName); driveFile != nil && driveFile.Size > 0 {
+			return driveFile.Size, true
+		}
+	}
+	return 0, false
+}
+
+// clampLength shortens the range to end at the end of a file of the given size
+func clampLength(offset, length, size int64) int64 {
+	if length > size-offset {
+		return size - offset
+	}
+	return length
+}
+
+func (g *GDrive) downloadRemoteRange(ctx context.Context, driveFile *drive.File, offset, length int64) ([]byte, error) {
+	var resp *http.Response
+	err := g.withRetry(ctx, func() (err error) {
+		call := g.filesGet(driveFile.Id).Context(ctx)
+		call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		resp, err = call.Download()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPartialContent {
+		return io.ReadAll(resp.Body)
+	}
+	// the server ignored the range and sent the whole file
+	_, err = io.CopyN(io.Discard, resp.Body, offset)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, length))
+}
+
+// minDownloadPartSize keeps small files from being split into tiny ranges
+const minDownloadPartSize = 1 << 20
+
+// downloadPartCount returns the number of parallel ranges used to download a file of the given size
+func (g *GDrive) downloadPartCount(size int64) int {
+	parts := g.config.DownloadParts
+	if max := int((size + minDownloadPartSize - 1) / minDownloadPartSize); parts > max {
+		parts = max
+	}
+	return parts
+}
+
+// downloadInParts downloads the file in parallel byte ranges and verifies the assembled content
+// against the md5 checksum of google drive
+func (g *GDrive) downloadInParts(ctx context.Context, driveFile *drive.File, parts int) ([]byte, error) {
+	retVal := make([]byte, driveFile.Size)
+	partSize := (driveFile.Size + int64(parts) - 1) / int64(parts)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	errs := make([]error, parts)
+	for i := 0; i < parts; i++ {
+		offset := int64(i) * partSize
+		length := partSize
+		if offset+length > driveFile.Size {
+			length = driveFile.Size - offset
+		}
+		wg.Add(1)
+		go func(i int, offset, length int64) {
+			defer wg.Done()
+			b, err := g.downloadRemoteRange(ctx, driveFile, offset, length)
+			if err == nil && int64(len(b)) != length {
+				err = fmt.Errorf("range %d+%d returned %d bytes", offset, length, len(b))
+			}
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+			copy(retVal[offset:], b)
+		}(i, offset, length)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	err := verifyMd5(driveFile, retVal)
+	if err != nil {
+		return nil, err
+	}
+	return retVal, nil
+}
+
+func (g *GDrive) segmentDir(filePathName string) string {
+	return filepath.Join(g.config.SegmentFolder, g.convertToGDrive(filePathName))
+}
+
+// removeSegments drops the cached segments of the file, they are stale once the file is written or deleted
+func (g *GDrive) removeSegments(filePathName string) error {
+	if g.config.SegmentFolder == "" {
+		return nil
+	}
+	return os.RemoveAll(g.segmentDir(filePathName))
+}
+
+// segmentFolder is the segment folder of one file, its modification time is the last time a segment was added
+type segmentFolder struct {
+	filePathName string
+	size         int64
+	modTime      time.Time
+}
+
+// segmentFolders lists the segment folders of every file
+func (g *GDrive) segmentFolders() ([]segmentFolder, error) {
+	if g.config.SegmentFolder == "" {
+		return []segmentFolder{}, nil
+	}
+	entries, err := os.ReadDir(g.config.SegmentFolder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []segmentFolder{}, nil
+		}
+		return nil, err
+	}
+	retVal := []segmentFolder{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		folder := segmentFolder{filePathName: g.convertFromGDrive(entry.Name()), modTime: info.ModTime()}
+		parts, err := os.ReadDir(filepath.Join(g.config.SegmentFolder, entry.Name()))
+		if err != nil {
+			continue
+		}
+		for _, part := range parts {
+			if info, err := part.Info(); err == nil && !info.IsDir() {
+				folder.size += info.Size()
+			}
+		}
+		retVal = append(retVal, folder)
+	}
+	return retVal, nil
+}
+
+// segmentsSize returns the bytes of every cached segment
+func (g *GDrive) segmentsSize() (int64, error) {
+	folders, err := g.segmentFolders()
+	if err != nil {
+		return 0, err
+	}
+	var retVal int64
+	for i := range folders {
+		retVal += folders[i].size
+	}
+	return retVal, nil
+}
+
+// evictSegments removes the segment folders least recently added to until need bytes are freed,
+// folders of files in use are skipped. It returns the freed bytes.
+func (g *GDrive) evictSegments(need int64) int64 {
+	folders, err := g.segmentFolders()
+	if err != nil {
+		g.logger().Errorf("unable to list segments: %v", err)
+		return 0
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].modTime.Before(folders[j].modTime) })
+	var freed int64
+	for i := range folders {
+		if freed >= need {
+			break
+		}
+		unlock, inUse := g.claimForEviction(folders[i].filePathName)
+		if inUse {
+			continue
+		}
+		err := g.removeSegments(folders[i].filePathName)
+		unlock()
+		if err != nil {
+			g.logger().Errorf("unable to remove segments of %s: %v", folders[i].filePathName, err)
+			continue
+		}
+		freed += folders[i].size
+	}
+	return freed
+}
+
+// segments lists the cached segments of the file, the folder listing is the segment index
+func (g *GDrive) segments(filePathName string) ([]segment, error) {
+	entries, err := os.ReadDir(g.segmentDir(filePathName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []segment{}, nil
+		}
+		return nil, err
+	}
+	retVal := []segment{}
+	for _, entry := range entries {
+		var seg segment
+		_, err := fmt.Sscanf(strings.TrimSuffix(entry.Name(), ".part"), "%d-%d", &seg.Offset, &seg.Length)
+		if err != nil || !strings.HasSuffix(entry.Name(), ".part") {
+			continue
+		}
+		retVal = append(retVal, seg)
+	}
+	sort.Slice(retVal, func(i, j int) bool { return retVal[i].Offset < retVal[j].Offset })
+	return retVal, nil
+}
+
+func (g *GDrive) segmentPath(filePathName string, seg segment) string {
+	return filepath.Join(g.segmentDir(filePathName), fmt.Sprintf("%d-%d.part", seg.Offset, seg.Length))
+}
+
+func (g *GDrive) readSegment(filePathName string, seg segment, offset, length int64) ([]byte, error) {
+	f, err := os.Open(g.segmentPath(filePathName, seg))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, length)
+	_, err = f.ReadAt(b, offset)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (g *GDrive) writeSegment(filePathName string, seg segment, b []byte) error {
+	err := g.mkdirAll(g.segmentDir(filePathName))
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a half written segment is never listed
+	tmp, err := g.writeTemp(g.segmentDir(filePathName), b)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, g.segmentPath(filePathName, seg))
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package gdrive
+
+import "google.golang.org/api/drive/v3"
+
+// the files calls below target the shared drive of Config.DriveID when it is set, or my drive otherwise
+
+func (g *GDrive) filesList() *drive.FilesListCall {
+	call := g.service().Files.List()
+	if g.config.DriveID != "" {
+		call = call.SupportsAllDrives(true).Corpora("drive").DriveId(g.config.DriveID).IncludeItemsFromAllDrives(true)
+	}
+	return call
+}
+
+func (g *GDrive) filesCreate(file *drive.File) *drive.FilesCreateCall {
+	call := g.service().Files.Create(file)
+	if g.config.DriveID != "" {
+		call = call.SupportsAllDrives(true)
+	}
+	return call
+}
+
+func (g *GDrive) filesUpdate(fileID string, file *drive.File) *drive.FilesUpdateCall {
+	call := g.service().Files.Update(fileID, file)
+	if g.config.DriveID != "" {
+		call = call.SupportsAllDrives(true)
+	}
+	return call
+}
+
+func (g *GDrive) filesDelete(fileID string) *drive.FilesDeleteCall {
+	call := g.service().Files.Delete(fileID)
+	if g.config.DriveID != "" {
+		call = call.SupportsAllDrives(true)
+	}
+	return call
+}
+
+func (g *GDrive) filesGet(fileID string) *drive.FilesGetCall {
+	call := g.service().Files.Get(fileID)
+	if g.config.DriveID != "" {
+		call = call.SupportsAllDrives(true)
+	}
+	return call
+}
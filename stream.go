@@ -0,0 +1,269 @@
+package gdrive
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// StoreFileStream stores the content of the reader without holding it in memory, it is written to the local
+// cache while being uploaded. A negative size means the length is unknown, otherwise a stream of another length fails.
+// A failed store never leaves a partial file in the cache. Encrypted content is read into memory first.
+// The path is resolved like StoreFile does, with Config.DatePartition and Config.ConflictMode.
+func (g *GDrive) StoreFileStream(ctx context.Context, filePathName string, r io.Reader, size int64, replace bool) error {
+	if g.service() == nil {
+		return ErrNotAuthenticated
+	}
+	if g.encodesContent() {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if size >= 0 && int64(len(b)) != size {
+			return fmt.Errorf("%s: read %d bytes, expected %d", filePathName, len(b), size)
+		}
+		return g.StoreFile(ctx, &FileInsertInfo{Filepath: filePathName, FileBytes: b, Replace: replace})
+	}
+	if g.config.RejectEmpty {
+		var err error
+		r, err = nonEmpty(filePathName, r, size)
+		if err != nil {
+			return err
+		}
+	}
+	filePathName, _, unlock, err := g.claimStorePath(ctx, filePathName, replace, 0)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	localPath := g.localFullPath(filePathName)
+	err = g.mkdirAll(filepath.Dir(localPath))
+	if err != nil {
+		return err
+	}
+	// the previous cache file stays in place until the new content is complete
+	f, err := g.createTemp(filepath.Dir(localPath))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	committed := false
+	defer func() {
+		f.Close()
+		if !committed {
+			os.Remove(tmp)
+		}
+	}()
+
+	sum := sha256.New()
+	counter := &countingWriter{}
+	res, err := g.uploadToCloud(ctx, filePathName, io.TeeReader(r, io.MultiWriter(f, sum, counter)), uploadOptions{replace: replace, size: size})
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	if size >= 0 && counter.n != size {
+		return fmt.Errorf("%s: read %d bytes, expected %d", filePathName, counter.n, size)
+	}
+
+	contentHash := ""
+	if g.config.ContentAddressedLocal {
+		contentHash = hex.EncodeToString(sum.Sum(nil))
+	}
+	err = g.commitLocal(localPath, tmp, contentHash)
+	if err != nil {
+		return err
+	}
+	committed = true
+	g.setPlaceholder(filePathName, false)
+	err = g.removeSegments(filePathName)
+	if err != nil {
+		return err
+	}
+
+	if g.dao != nil {
+		g.dao.InsertOrUpdate(ctx, &FileInfo{FileID: res.Id, LastAccess: g.now(), Filepath: filePathName, Size: counter.n,
+			MimeType: res.MimeType, Description: res.Description, Version: res.Version, ContentHash: contentHash,
+			Md5: res.Md5Checksum})
+	}
+	g.recordAccess(AccessStore, filePathName, counter.n)
+	return nil
+}
+
+// ReadFileStream returns a reader of the cached file. On a cache miss the google drive download is returned
+// directly while being written to the cache, the cached copy is only kept when the whole stream was read
+// before Close. The reader must always be closed. Encrypted content is decrypted in memory.
+func (g *GDrive) ReadFileStream(ctx context.Context, filePathName string) (io.ReadCloser, error) {
+	if g.service() == nil {
+		return nil, ErrNotAuthenticated
+	}
+	if g.encodesContent() {
+		b, err := g.readFile(ctx, filePathName)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	f, err := os.Open(g.localFullPath(filePathName))
+	if err == nil {
+		if g.dao != nil {
+			g.dao.Touch(ctx, filePathName, g.now())
+		}
+		if stat, err := f.Stat(); err == nil {
+			g.recordAccess(AccessGet, filePathName, stat.Size())
+		}
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	driveFile, err := g.findRemote(ctx, filePathName)
+	if err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	err = g.withRetry(ctx, func() (err error) {
+		if exportMimeType := g.config.ExportMap[driveFile.MimeType]; exportMimeType != "" {
+			resp, err = g.service().Files.Export(driveFile.Id, exportMimeType).Context(ctx).Download()
+			return err
+		}
+		resp, err = g.filesGet(driveFile.Id).Context(ctx).Download()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	localPath := g.localFullPath(filePathName)
+	err = g.mkdirAll(filepath.Dir(localPath))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	tmp, err := g.createTemp(filepath.Dir(localPath))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	g.startDownload(filePathName)
+	return &cacheFillReader{g: g, ctx: ctx, filePathName: filePathName, driveFile: driveFile, body: resp.Body,
+		tmp: tmp, hash: sha256.New(), md5: md5.New()}, nil
+}
+
+// cacheFillReader copies everything read from the body into a temporary cache file,
+// which is committed on Close when the body was read until the end
+type cacheFillReader struct {
+	g            *GDrive
+	ctx          context.Context
+	filePathName string
+	driveFile    *drive.File
+	body         io.ReadCloser
+	tmp          *os.File
+	hash         hash.Hash
+	md5          hash.Hash
+	n            int64
+	eof          bool
+	writeErr     error
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+func (r *cacheFillReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && r.writeErr == nil {
+		// a failing cache write only costs the cached copy, the caller still gets the content
+		_, r.writeErr = r.tmp.Write(p[:n])
+		r.hash.Write(p[:n])
+		r.md5.Write(p[:n])
+		r.n += int64(n)
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *cacheFillReader) Close() error {
+	r.closeOnce.Do(func() {
+		defer r.g.finishDownload(r.filePathName)
+		r.closeErr = r.body.Close()
+		err := r.tmp.Close()
+		if !r.eof || r.writeErr != nil || err != nil {
+			os.Remove(r.tmp.Name())
+			return
+		}
+		exported := r.g.config.ExportMap[r.driveFile.MimeType] != ""
+		if !exported && r.driveFile.Md5Checksum != "" && hex.EncodeToString(r.md5.Sum(nil)) != r.driveFile.Md5Checksum {
+			os.Remove(r.tmp.Name())
+			r.closeErr = fmt.Errorf("%s: %w", r.driveFile.Id, ErrChecksumMismatch)
+			return
+		}
+		contentHash := ""
+		if r.g.config.ContentAddressedLocal {
+			contentHash = hex.EncodeToString(r.hash.Sum(nil))
+		}
+		err = r.g.commitLocal(r.g.localFullPath(r.filePathName), r.tmp.Name(), contentHash)
+		if err != nil {
+			os.Remove(r.tmp.Name())
+			r.closeErr = err
+			return
+		}
+		r.g.removeSegments(r.filePathName)
+		r.g.recordDownload(r.ctx, r.filePathName, r.driveFile, r.n, 0, contentHash)
+		r.g.recordAccess(AccessGet, r.filePathName, r.n)
+	})
+	return r.closeErr
+}
+
+// commitLocal moves a fully written temporary file to its place in the cache
+func (g *GDrive) commitLocal(localPath, tmp, contentHash string) error {
+	if g.config.ContentAddressedLocal {
+		return g.linkBlob(localPath, contentHash, tmp)
+	}
+	err := os.Rename(tmp, localPath)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// nonEmpty returns a reader of the same content, failing with ErrEmptyFile when the stream has no content
+func nonEmpty(filePathName string, r io.Reader, size int64) (io.Reader, error) {
+	if size == 0 {
+		return nil, fmt.Errorf("%s: %w", filePathName, ErrEmptyFile)
+	}
+	var first [1]byte
+	n, err := io.ReadFull(r, first[:])
+	if n == 0 {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s: %w", filePathName, ErrEmptyFile)
+		}
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(first[:]), r), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
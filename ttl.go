@@ -0,0 +1,36 @@
+package gdrive
+
+import "context"
+
+// expireOnce evicts the files not accessed within Config.TTL, files in use are left for the next pass
+func (g *GDrive) expireOnce(ctx context.Context) {
+	if g.dao == nil || g.config.TTL <= 0 {
+		return
+	}
+	expired, err := g.dao.QueryExpired(ctx, g.now().Add(-g.config.TTL))
+	if err != nil {
+		g.logger().Errorf("unable to query expired files from dao: %v", err)
+		return
+	}
+	toRemove := []FileInfo{}
+	unlocks := []func(){}
+	for i := range expired {
+		if g.isPinned(expired[i].Filepath) {
+			continue
+		}
+		unlock, inUse := g.claimForEviction(expired[i].Filepath)
+		if inUse {
+			continue
+		}
+		unlocks = append(unlocks, unlock)
+		toRemove = append(toRemove, expired[i])
+	}
+	removed, _ := g.removeEvicted(ctx, toRemove)
+	for _, unlock := range unlocks {
+		unlock()
+	}
+	if removed > 0 {
+		g.logger().Debugf("evicted %d expired files", removed)
+		g.metrics().IncEviction(removed)
+	}
+}